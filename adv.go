@@ -57,7 +57,7 @@ const (
 	flagBothHost            = 0x10 // Simultaneous LE and BR/EDR to Same Device Capable (Host).
 )
 
-// FIXME: check the unmarshalling of this data structure.
+// ServiceData is the data associated with a service in the advertisement.
 type ServiceData struct {
 	UUID UUID
 	Data []byte
@@ -127,9 +127,12 @@ func (a *Advertisement) unmarshall(b []byte) error {
 		case typeManufacturerData:
 			a.ManufacturerData = make([]byte, len(d))
 			copy(a.ManufacturerData, d)
-		// case typeServiceData16,
-		// case typeServiceData32,
-		// case typeServiceData128:
+		case typeServiceData16:
+			a.ServiceData = serviceData(a.ServiceData, d, 2)
+		case typeServiceData32:
+			a.ServiceData = serviceData(a.ServiceData, d, 4)
+		case typeServiceData128:
+			a.ServiceData = serviceData(a.ServiceData, d, 16)
 		default:
 			log.Printf("DATA: [ % X ]", d)
 		}
@@ -138,6 +141,28 @@ func (a *Advertisement) unmarshall(b []byte) error {
 	return nil
 }
 
+// serviceData appends the service data field d, of which the UUID is w bytes, to sd.
+// A 32-bit UUID is expanded to 128 bits, as UUIDs are either 16 or 128 bits.
+func serviceData(sd []ServiceData, d []byte, w int) []ServiceData {
+	if len(d) < w {
+		return sd
+	}
+	b := make([]byte, len(d)-w)
+	copy(b, d[w:])
+	u := UUID{append([]byte{}, d[:w]...)}
+	if w == 4 {
+		u = uuid32(d[:w])
+	}
+	return append(sd, ServiceData{UUID: u, Data: b})
+}
+
+// uuid32 expands the 32-bit UUID b, in little-endian, to 128 bits with the Bluetooth Base UUID.
+func uuid32(b []byte) UUID {
+	u := []byte{0xFB, 0x34, 0x9B, 0x5F, 0x80, 0x00, 0x00, 0x80, 0x00, 0x10, 0x00, 0x00, 0, 0, 0, 0}
+	copy(u[12:], b)
+	return UUID{u}
+}
+
 // AdvPacket is an utility to help crafting advertisment or scan response data.
 type AdvPacket struct {
 	b []byte
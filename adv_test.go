@@ -108,3 +108,30 @@ func TestAppendUUIDFit(t *testing.T) {
 	// 	}
 	// }
 }
+
+func TestUnmarshallServiceData(t *testing.T) {
+	b := []byte{
+		0x05, typeServiceData16, 0x0F, 0x18, 0x64, 0x01, // Battery Service: 0x64, 0x01
+		0x13, typeServiceData128,
+		0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB,
+		0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0xAB, 0x02, 0x03,
+		0x06, typeServiceData32, 0x78, 0x56, 0x34, 0x12, 0x04, // 32-bit UUID 0x12345678: 0x04
+	}
+	a := &Advertisement{}
+	if err := a.unmarshall(b); err != nil {
+		t.Fatalf("unmarshall: %v", err)
+	}
+	want := []ServiceData{
+		{UUID: UUID16(0x180F), Data: []byte{0x64, 0x01}},
+		{UUID: MustParseUUID("ABABABABABABABABABABABABABABABAB"), Data: []byte{0x02, 0x03}},
+		{UUID: MustParseUUID("12345678-0000-1000-8000-00805F9B34FB"), Data: []byte{0x04}},
+	}
+	if len(a.ServiceData) != len(want) {
+		t.Fatalf("service data: got %d want %d", len(a.ServiceData), len(want))
+	}
+	for i, sd := range a.ServiceData {
+		if !sd.UUID.Equal(want[i].UUID) || string(sd.Data) != string(want[i].Data) {
+			t.Errorf("service data %d: got %s [% X] want %s [% X]", i, sd.UUID, sd.Data, want[i].UUID, want[i].Data)
+		}
+	}
+}
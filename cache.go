@@ -0,0 +1,74 @@
+package gatt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An AttributeCache stores the profiles of remote peripherals across
+// connections, so that they don't have to be discovered on every connection.
+// The profiles are keyed by the ID of the peripherals.
+type AttributeCache interface {
+	// Load returns the profile stored for the peripheral id,
+	// or nil if there is none.
+	Load(id string) (*Profile, error)
+
+	// Store stores the profile of the peripheral id.
+	Store(id string, pf *Profile) error
+
+	// Remove removes the profile stored for the peripheral id, if any.
+	Remove(id string) error
+}
+
+// NewFileCache returns an AttributeCache, which stores each profile
+// as a JSON file in the directory dir.
+func NewFileCache(dir string) AttributeCache {
+	return fileCache(dir)
+}
+
+type fileCache string
+
+func (fc fileCache) path(id string) string {
+	return filepath.Join(string(fc), strings.Replace(id, ":", "", -1)+".json")
+}
+
+func (fc fileCache) Load(id string) (*Profile, error) {
+	b, err := ioutil.ReadFile(fc.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pf := &Profile{}
+	if err := json.Unmarshal(b, pf); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+func (fc fileCache) Store(id string, pf *Profile) error {
+	b, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(string(fc), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash doesn't leave a partial profile.
+	tmp := fc.path(id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fc.path(id))
+}
+
+func (fc fileCache) Remove(id string) error {
+	if err := os.Remove(fc.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package gatt
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gatt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Service{uuid: UUID16(0x180F), h: 0x0001, endh: 0x0005, chars: []*Characteristic{}}
+	c := &Characteristic{uuid: UUID16(0x2A19), svc: s, props: CharRead | CharNotify, h: 0x0002, vh: 0x0003, endh: 0x0005}
+	c.descs = []*Descriptor{{uuid: attrClientCharacteristicConfigUUID, char: c, h: 0x0004}}
+	s.chars = append(s.chars, c)
+	u := &Service{uuid: MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b"), h: 0x0006, endh: 0xFFFF}
+
+	fc := NewFileCache(dir)
+	if pf, err := fc.Load("AA:BB:CC:DD:EE:FF"); pf != nil || err != nil {
+		t.Fatalf("load: got %v, %v want nil, nil", pf, err)
+	}
+	want := newProfile([]*Service{s, u})
+	want.Hash = []byte{0x01, 0x02}
+	if err := fc.Store("AA:BB:CC:DD:EE:FF", want); err != nil {
+		t.Fatalf("store: got err %v want nil", err)
+	}
+	got, err := fc.Load("AA:BB:CC:DD:EE:FF")
+	if err != nil {
+		t.Fatalf("load: got err %v want nil", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("load: got %+v want %+v", got, want)
+	}
+
+	svcs := got.services()
+	if len(svcs) != 2 || svcs[1].chars != nil {
+		t.Fatalf("services: undiscovered characteristics not preserved")
+	}
+	rc := svcs[0].chars[0]
+	if !rc.uuid.Equal(c.uuid) || rc.vh != c.vh || rc.svc != svcs[0] || rc.cccd == nil || rc.cccd.h != 0x0004 {
+		t.Errorf("services: got characteristic %+v", rc)
+	}
+
+	if err := fc.Remove("AA:BB:CC:DD:EE:FF"); err != nil {
+		t.Fatalf("remove: got err %v want nil", err)
+	}
+	if pf, err := fc.Load("AA:BB:CC:DD:EE:FF"); pf != nil || err != nil {
+		t.Errorf("load removed: got %v, %v want nil, nil", pf, err)
+	}
+}
@@ -24,9 +24,10 @@ func newCentral(d *device, u UUID) *central {
 	}
 }
 
-func (c *central) ID() string   { return c.uuid.String() }
-func (c *central) Close() error { return nil }
-func (c *central) MTU() int     { return c.mtu }
+func (c *central) ID() string     { return c.uuid.String() }
+func (c *central) Resolved() bool { return false }
+func (c *central) Close() error   { return nil }
+func (c *central) MTU() int       { return c.mtu }
 
 func (c *central) sendNotification(a *attr, b []byte) (int, error) {
 	data := make([]byte, len(b))
@@ -19,6 +19,7 @@ type central struct {
 	attrs       *attrRange
 	mtu         uint16
 	addr        net.HardwareAddr
+	resolved    bool
 	security    security
 	l2conn      io.ReadWriteCloser
 	notifiers   map[uint16]*notifier
@@ -41,6 +42,8 @@ func (c *central) ID() string {
 	return c.addr.String()
 }
 
+func (c *central) Resolved() bool { return c.resolved }
+
 func (c *central) Close() error {
 	c.notifiersmu.Lock()
 	defer c.notifiersmu.Unlock()
@@ -54,7 +57,9 @@ func (c *central) MTU() int {
 	return int(c.mtu)
 }
 
-func (c *central) loop() {
+// loop serves the requests of the central until it disconnects,
+// and returns the error that ended the connection.
+func (c *central) loop() error {
 	for {
 		// L2CAP implementations shall support a minimum MTU size of 48 bytes.
 		// The default value is 672 bytes
@@ -62,7 +67,7 @@ func (c *central) loop() {
 		n, err := c.l2conn.Read(b)
 		if n == 0 || err != nil {
 			c.Close()
-			break
+			return err
 		}
 		if rsp := c.handleReq(b[:n]); rsp != nil {
 			c.l2conn.Write(rsp)
@@ -20,6 +20,8 @@ var (
 	attrReconnectionAddrUUID  = UUID16(0x2A03)
 	attrPeferredParamsUUID    = UUID16(0x2A04)
 	attrServiceChangedUUID    = UUID16(0x2A05)
+
+	attrDatabaseHashUUID = UUID16(0x2B2A)
 )
 
 const (
@@ -55,6 +57,8 @@ const (
 	attOpHandleNotify       = 0x1b
 	attOpHandleInd          = 0x1d
 	attOpHandleCnf          = 0x1e
+	attOpReadMultiVarReq    = 0x20
+	attOpReadMultiVarRsp    = 0x21
 	attOpSignedWriteCmd     = 0xd2
 )
 
@@ -133,6 +137,7 @@ var attRspFor = map[byte]byte{
 	attOpReadReq:            attOpReadRsp,
 	attOpReadBlobReq:        attOpReadBlobRsp,
 	attOpReadMultiReq:       attOpReadMultiRsp,
+	attOpReadMultiVarReq:    attOpReadMultiVarRsp,
 	attOpReadByGroupReq:     attOpReadByGroupRsp,
 	attOpWriteReq:           attOpWriteRsp,
 	attOpPrepWriteReq:       attOpPrepWriteRsp,
@@ -1,6 +1,9 @@
 package gatt
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 var notImplemented = errors.New("not implemented")
 
@@ -27,6 +30,14 @@ func (s State) String() string {
 	return str[int(s)]
 }
 
+// AddressType is the type of a Bluetooth LE device address.
+type AddressType uint8
+
+const (
+	AddressPublic AddressType = 0 // Public Device Address
+	AddressRandom AddressType = 1 // Random Device Address
+)
+
 // Device defines the interface for a BLE device.
 // Since an interface can't define fields(properties). To implement the
 // callback support for cerntain events, deviceHandler is defined and
@@ -72,6 +83,12 @@ type Device interface {
 	// Connect connects to a remote peripheral.
 	Connect(p Peripheral)
 
+	// Dial connects to the remote peripheral with the specified address, which doesn't have to be discovered by Scan first.
+	// The address is in the same form as the ID of the peripheral, such as "00:11:22:33:44:55".
+	// It blocks until the peripheral is connected, the connection fails, or ctx is done, in which case the connection attempt is cancelled.
+	// The PeripheralConnected Handler is also called for the connected peripheral.
+	Dial(ctx context.Context, addr string, t AddressType) (Peripheral, error)
+
 	// CancelConnection disconnects a remote peripheral.
 	CancelConnection(p Peripheral)
 
@@ -91,7 +108,7 @@ type deviceHandler struct {
 	centralConnected func(c Central)
 
 	// disconnect is called when a remote central device disconnects to the device.
-	centralDisconnected func(c Central)
+	centralDisconnected func(c Central, err error)
 
 	// peripheralDiscovered is called when a remote peripheral device is found during scan procedure.
 	peripheralDiscovered func(p Peripheral, a *Advertisement, rssi int)
@@ -101,6 +118,15 @@ type deviceHandler struct {
 
 	// peripheralConnected is called when a remote peripheral is disconneted.
 	peripheralDisconnected func(p Peripheral, err error)
+
+	// peripheralConnParamsUpdated is called when the parameters of the connection to a remote peripheral have been updated.
+	peripheralConnParamsUpdated func(p Peripheral, cp ConnParams, err error)
+
+	// peripheralNameChanged is called when the GAP device name of a remote peripheral has changed.
+	peripheralNameChanged func(p Peripheral)
+
+	// peripheralServicesModified is called when services of a remote peripheral have changed.
+	peripheralServicesModified func(p Peripheral, invalid []*Service)
 }
 
 // A Handler is a self-referential function, which registers the options specified.
@@ -121,6 +147,14 @@ func CentralConnected(f func(Central)) Handler {
 
 // CentralDisconnected returns a Handler, which sets the specified function to be called when a device disconnects from the server.
 func CentralDisconnected(f func(Central)) Handler {
+	return func(d Device) { d.(*device).centralDisconnected = func(c Central, err error) { f(c) } }
+}
+
+// CentralDisconnectedWithReason returns a Handler, which sets the specified function to be called when a device disconnects from the server.
+// The reason of the disconnection, if known, is passed as the error; on Linux, it's a cmd.Error.
+// A disconnection initiated by the server is reported with a nil error.
+// It replaces the function set by CentralDisconnected, and vice versa.
+func CentralDisconnectedWithReason(f func(Central, error)) Handler {
 	return func(d Device) { d.(*device).centralDisconnected = f }
 }
 
@@ -135,10 +169,30 @@ func PeripheralConnected(f func(Peripheral, error)) Handler {
 }
 
 // PeripheralDisconnected returns a Handler, which sets the specified function to be called when a remote peripheral device disconnects.
+// The reason of the disconnection, if known, is passed as the error; on Linux, it's a cmd.Error.
+// A disconnection initiated locally is reported with a nil error.
 func PeripheralDisconnected(f func(Peripheral, error)) Handler {
 	return func(d Device) { d.(*device).peripheralDisconnected = f }
 }
 
+// PeripheralConnParamsUpdated returns a Handler, which sets the specified function to be called when the parameters of the connection to a remote peripheral have been updated,
+// either requested by UpdateConnParams or by the peripheral. IntervalMin and IntervalMax are both set to the connection interval in use.
+// If the update failed, the reason is passed as the error.
+func PeripheralConnParamsUpdated(f func(Peripheral, ConnParams, error)) Handler {
+	return func(d Device) { d.(*device).peripheralConnParamsUpdated = f }
+}
+
+// PeripheralNameChanged returns a Handler, which sets the specified function to be called when the GAP device name of a remote peripheral has changed.
+func PeripheralNameChanged(f func(Peripheral)) Handler {
+	return func(d Device) { d.(*device).peripheralNameChanged = f }
+}
+
+// PeripheralServicesModified returns a Handler, which sets the specified function to be called when services of a remote peripheral have changed.
+// The services that are no longer valid are passed to the function; the services rediscovered in their place are available from Services.
+func PeripheralServicesModified(f func(Peripheral, []*Service)) Handler {
+	return func(d Device) { d.(*device).peripheralServicesModified = f }
+}
+
 // An Option is a self-referential function, which sets the option specified.
 // Most Options are platform-specific, which gives more fine-grained control over the device at a cost of losing portibility.
 // See http://commandcenter.blogspot.com.au/2014/01/self-referential-functions-and-design.html for more discussion.
@@ -1,6 +1,7 @@
 package gatt
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -31,6 +32,10 @@ type device struct {
 	attrs map[int]*attr
 
 	subscribers map[string]*central
+
+	// scanFilter selects the advertisements reported during scan.
+	scanFilter *ScanFilter
+	scanmu     sync.Mutex
 }
 
 func NewDevice(opts ...Option) (Device, error) {
@@ -230,6 +235,11 @@ func (d *device) Connect(p Peripheral) {
 		})
 }
 
+// Dial is not supported on Darwin, where peripherals are not identified by their addresses.
+func (d *device) Dial(ctx context.Context, addr string, t AddressType) (Peripheral, error) {
+	return nil, notImplemented
+}
+
 func (d *device) respondToRequest(id int, args xpc.Dict) {
 
 	switch id {
@@ -371,14 +381,21 @@ func (d *device) HandleXpcEvent(event xpc.Dict, err error) {
 			xsd := xsds.(xpc.Array)
 			for i := 0; i < len(xsd); i += 2 {
 				sd := ServiceData{
-					UUID: UUID{xsd[i].([]byte)},
+					UUID: UUID{reverse(xsd[i].([]byte))},
 					Data: xsd[i+1].([]byte),
 				}
+				if sd.UUID.Len() == 4 {
+					sd.UUID = uuid32(sd.UUID.b)
+				}
 				a.ServiceData = append(a.ServiceData, sd)
 			}
 		}
-		if d.peripheralDiscovered != nil {
-			go d.peripheralDiscovered(&peripheral{id: xpc.UUID(u.b), d: d}, a, rssi)
+		p := &peripheral{id: xpc.UUID(u.b), d: d}
+		d.scanmu.Lock()
+		ok := d.scanFilter.match(p, a, rssi)
+		d.scanmu.Unlock()
+		if ok && d.peripheralDiscovered != nil {
+			go d.peripheralDiscovered(p, a, rssi)
 		}
 
 	case 38: // PeripheralConnected
@@ -1,8 +1,15 @@
 package gatt
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/paypal/gatt/linux"
 	"github.com/paypal/gatt/linux/cmd"
@@ -22,10 +29,86 @@ type device struct {
 	chkLE   bool
 	maxConn int
 
+	// attrCache, if set, stores the profiles of remote peripherals across connections.
+	attrCache AttributeCache
+
+	// dials are the peripherals being connected by Dial.
+	dials  map[*linux.PlatData]chan Peripheral
+	dialmu sync.Mutex
+
+	// connParams, if set, are the parameters of the connections initiated by Connect and Dial.
+	connParams *linux.ConnParams
+
+	// periphs are the connected remote peripherals.
+	periphs   map[*linux.PlatData]*peripheral
+	periphsmu sync.Mutex
+
+	// scanSvcs and scanFilter select the advertisements reported during scan.
+	scanSvcs   []UUID
+	scanFilter *ScanFilter
+	scanmu     sync.Mutex
+
+	// scanning reports whether Scan is in effect, and scanDup is its dup argument.
+	scanning bool
+	scanDup  bool
+
+	// scanOn and scanPeriod, if set, duty-cycle the scan.
+	// The duty cycle runs until scanQuit is closed, and then closes scanDone.
+	scanOn     time.Duration
+	scanPeriod time.Duration
+	scanQuit   chan struct{}
+	scanDone   chan struct{}
+
+	// autoCancel, if set, stops the auto-connect, which closes autoDone once stopped.
+	autoCancel context.CancelFunc
+	autoDone   chan struct{}
+
+	// readName, if set, reads the GAP device name of remote peripherals once connected.
+	readName bool
+
 	advData   *cmd.LESetAdvertisingData
 	scanResp  *cmd.LESetScanResponseData
 	advParam  *cmd.LESetAdvertisingParameters
 	scanParam *cmd.LESetScanParameters
+
+	// advParamSent are the advertising parameters last sent to the HCI device.
+	advParamSent cmd.LESetAdvertisingParameters
+
+	// irks are the IRKs added before the HCI device is opened.
+	irks []linux.IRK
+
+	// captureW and captureF are the capture set before the HCI device is opened.
+	captureW io.Writer
+	captureF linux.CaptureFormat
+
+	// resolving, if set, enables the address resolution by the controller.
+	resolving bool
+
+	// own is the own address of the device, and rpaQuit, if set, stops its rotation.
+	// Both are guarded by scanmu.
+	own     ownAddress
+	rpaQuit chan struct{}
+}
+
+// ownAddress is the address the device advertises, scans and connects with.
+type ownAddress struct {
+	typ    uint8         // 0x00: public, 0x01: random
+	static [6]byte       // random static address, if typ is random and irk is nil
+	irk    *[16]byte     // IRK of the resolvable private addresses, if any
+	rotate time.Duration // rotation interval of the resolvable private addresses
+}
+
+// LnxDevice is implemented by the Device of Linux implementation,
+// which also reports the information of its controller.
+//
+//	if d, ok := d.(gatt.LnxDevice); ok {
+//		log.Printf("controller: %s", d.ControllerInfo())
+//	}
+type LnxDevice interface {
+	Device
+
+	// ControllerInfo returns the information of the controller, which is read at startup.
+	ControllerInfo() linux.ControllerInfo
 }
 
 func NewDevice(opts ...Option) (Device, error) {
@@ -34,6 +117,9 @@ func NewDevice(opts ...Option) (Device, error) {
 		devID:   -1,   // Find an available HCI device.
 		chkLE:   true, // Check if the device supports LE.
 
+		dials:   map[*linux.PlatData]chan Peripheral{},
+		periphs: map[*linux.PlatData]*peripheral{},
+
 		advParam: &cmd.LESetAdvertisingParameters{
 			AdvertisingIntervalMin:  0x800,     // [0x0800]: 0.625 ms * 0x0800 = 1280.0 ms
 			AdvertisingIntervalMax:  0x800,     // [0x0800]: 0.625 ms * 0x0800 = 1280.0 ms
@@ -44,52 +130,113 @@ func NewDevice(opts ...Option) (Device, error) {
 			AdvertisingChannelMap:   0x7,       // [0x07] 0x01: ch37, 0x2: ch38, 0x4: ch39
 			AdvertisingFilterPolicy: 0x00,
 		},
-		scanParam: &cmd.LESetScanParameters{
-			LEScanType:           0x01,   // [0x00]: passive, 0x01: active
-			LEScanInterval:       0x0010, // [0x10]: 0.625ms * 16
-			LEScanWindow:         0x0010, // [0x10]: 0.625ms * 16
-			OwnAddressType:       0x00,   // [0x00]: public, 0x01: random
-			ScanningFilterPolicy: 0x00,   // [0x00]: accept all, 0x01: ignore non-white-listed.
-		},
 	}
+	d.scanParam, _ = lnxScanParams(DefaultScanParams)
 
 	d.Option(opts...)
-	h, err := linux.NewHCI(d.devID, d.chkLE, d.maxConn)
+	h, err := linux.NewHCICapture(d.devID, d.chkLE, d.maxConn, d.captureW, d.captureF)
+	d.captureW = nil
 	if err != nil {
 		return nil, err
 	}
 
+	if d.connParams != nil {
+		h.SetConnParams(*d.connParams)
+	}
+	for _, k := range d.irks {
+		h.AddIRK(k)
+	}
+	d.irks = nil
+
 	d.hci = h
+	if d.own.typ != 0x00 {
+		if err := d.setOwnAddress(d.own); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+	if d.resolving {
+		if err := d.setAddressResolution(true); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
 	return d, nil
 }
 
 func (d *device) Init(f func(Device, State)) error {
 	d.hci.AcceptMasterHandler = func(pd *linux.PlatData) {
 		a := pd.Address
-		c := newCentral(d.attrs, net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]}), pd.Conn)
+		addr := net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]})
+		if pd.Resolved {
+			// The identity address is reported as given by LnxAddIRK.
+			addr = net.HardwareAddr(pd.IdentityAddress[:])
+		}
+		c := newCentral(d.attrs, addr, pd.Conn)
+		c.resolved = pd.Resolved
 		if d.centralConnected != nil {
 			d.centralConnected(c)
 		}
-		c.loop()
+		err := c.loop()
 		if d.centralDisconnected != nil {
-			d.centralDisconnected(c)
+			d.centralDisconnected(c, disconnectReason(err))
 		}
 	}
 	d.hci.AcceptSlaveHandler = func(pd *linux.PlatData) {
 		p := &peripheral{
 			d:     d,
 			pd:    pd,
+			mtu:   23,
 			l2c:   pd.Conn,
 			reqc:  make(chan message),
 			quitc: make(chan struct{}),
 			sub:   newSubscriber(),
 		}
-		if d.peripheralConnected != nil {
-			go d.peripheralConnected(p, nil)
+		d.periphsmu.Lock()
+		d.periphs[pd] = p
+		d.periphsmu.Unlock()
+		// reported tells whether the peripheral has been reported connected,
+		// so that a peripheral lost while setting up isn't reported disconnected.
+		reported := make(chan bool, 1)
+		go func() {
+			var err error
+			if d.attrCache != nil {
+				err = p.loadCache()
+			}
+			if err == nil && d.readName {
+				err = p.readName()
+			}
+			d.dialmu.Lock()
+			if c, ok := d.dials[pd]; ok {
+				if err != nil {
+					c <- nil
+				} else {
+					c <- p
+				}
+			}
+			d.dialmu.Unlock()
+			if err == nil && d.peripheralConnected != nil {
+				d.peripheralConnected(p, nil)
+			}
+			reported <- err == nil
+		}()
+		err := p.loop()
+		d.periphsmu.Lock()
+		delete(d.periphs, pd)
+		d.periphsmu.Unlock()
+		if d.attrCache != nil {
+			p.flushCache()
 		}
-		p.loop()
-		if d.peripheralDisconnected != nil {
-			d.peripheralDisconnected(p, nil)
+		if <-reported && d.peripheralDisconnected != nil {
+			d.peripheralDisconnected(p, disconnectReason(err))
+		}
+	}
+	d.hci.ConnParamsHandler = func(pd *linux.PlatData, cp linux.ConnParams, err error) {
+		d.periphsmu.Lock()
+		p, ok := d.periphs[pd]
+		d.periphsmu.Unlock()
+		if ok && d.peripheralConnParamsUpdated != nil {
+			d.peripheralConnParamsUpdated(p, gattConnParams(cp), err)
 		}
 	}
 	d.hci.AdvertisementHandler = func(pd *linux.PlatData) {
@@ -97,7 +244,10 @@ func (d *device) Init(f func(Device, State)) error {
 		a.unmarshall(pd.Data)
 		a.Connectable = pd.Connectable
 		p := &peripheral{pd: pd, d: d}
-		if d.peripheralDiscovered != nil {
+		d.scanmu.Lock()
+		ok := advertisesAny(a, d.scanSvcs) && d.scanFilter.match(p, a, int(pd.RSSI))
+		d.scanmu.Unlock()
+		if ok && d.peripheralDiscovered != nil {
 			pd.Name = a.LocalName
 			d.peripheralDiscovered(p, a, int(pd.RSSI))
 		}
@@ -108,6 +258,43 @@ func (d *device) Init(f func(Device, State)) error {
 	return nil
 }
 
+// disconnectReason returns the reason of a disconnection,
+// given the error that ended the connection.
+// A disconnection initiated locally has no reason, as it had none before the reasons were reported.
+func disconnectReason(err error) error {
+	if err == io.EOF || err == cmd.ErrLocalHost {
+		return nil
+	}
+	return err
+}
+
+// lnxConnParams converts p to the units of the controller.
+func lnxConnParams(p ConnParams) (linux.ConnParams, error) {
+	if err := p.validate(); err != nil {
+		return linux.ConnParams{}, err
+	}
+	return linux.ConnParams{
+		ConnIntervalMin:    uint16(p.IntervalMin / 1250 / time.Microsecond),
+		ConnIntervalMax:    uint16(p.IntervalMax / 1250 / time.Microsecond),
+		ConnLatency:        uint16(p.Latency),
+		SupervisionTimeout: uint16(p.SupervisionTimeout / 10 / time.Millisecond),
+		MinimumCELength:    uint16(p.MinCELength / 625 / time.Microsecond),
+		MaximumCELength:    uint16(p.MaxCELength / 625 / time.Microsecond),
+	}, nil
+}
+
+// gattConnParams converts p from the units of the controller.
+func gattConnParams(p linux.ConnParams) ConnParams {
+	return ConnParams{
+		IntervalMin:        time.Duration(p.ConnIntervalMin) * 1250 * time.Microsecond,
+		IntervalMax:        time.Duration(p.ConnIntervalMax) * 1250 * time.Microsecond,
+		Latency:            int(p.ConnLatency),
+		SupervisionTimeout: time.Duration(p.SupervisionTimeout) * 10 * time.Millisecond,
+		MinCELength:        time.Duration(p.MinimumCELength) * 625 * time.Microsecond,
+		MaxCELength:        time.Duration(p.MaximumCELength) * 625 * time.Microsecond,
+	}
+}
+
 func (d *device) Stop() error {
 	d.state = StatePoweredOff
 	defer d.stateChanged(d, d.state)
@@ -196,16 +383,204 @@ func (d *device) StopAdvertising() error {
 }
 
 func (d *device) Scan(ss []UUID, dup bool) {
-	// TODO: filter
-	d.hci.SetScanEnable(true, dup)
+	d.scanmu.Lock()
+	defer d.scanmu.Unlock()
+	d.scanSvcs = ss
+	d.scanDup = dup
+	d.scanning = true
+	if err := d.startScan(); err != nil {
+		log.Printf("can't start scanning: %s", err)
+	}
 }
 
 func (d *device) StopScanning() {
-	d.hci.SetScanEnable(false, true)
+	d.scanmu.Lock()
+	defer d.scanmu.Unlock()
+	d.scanning = false
+	d.stopScan()
+}
+
+// startScan applies the scan parameters, and enables scanning, duty-cycled if set.
+// It must be called with scanmu held.
+func (d *device) startScan() error {
+	d.stopScan()
+	c := *d.scanParam
+	if c.OwnAddressType == 0x00 {
+		c.OwnAddressType = d.own.typ
+	}
+	if err := d.hci.SetScanParameters(c); err != nil {
+		return err
+	}
+	if d.scanOn <= 0 || d.scanPeriod <= d.scanOn {
+		return d.hci.SetScanEnable(true, d.scanDup)
+	}
+	d.scanQuit = make(chan struct{})
+	d.scanDone = make(chan struct{})
+	go d.dutyCycle(d.scanQuit, d.scanDone, d.scanOn, d.scanPeriod, d.scanDup)
+	return nil
+}
+
+// stopScan stops the duty cycle, if any, and disables scanning.
+// It must be called with scanmu held.
+func (d *device) stopScan() error {
+	if d.scanQuit != nil {
+		close(d.scanQuit)
+		<-d.scanDone
+		d.scanQuit, d.scanDone = nil, nil
+	}
+	return d.hci.SetScanEnable(false, true)
+}
+
+// dutyCycle enables scanning for on of every period, until quit is closed.
+func (d *device) dutyCycle(quit, done chan struct{}, on, period time.Duration, dup bool) {
+	defer close(done)
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		d.hci.SetScanEnable(true, dup)
+		select {
+		case <-time.After(on):
+		case <-quit:
+			return
+		}
+		d.hci.SetScanEnable(false, true)
+		select {
+		case <-t.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (d *device) ControllerInfo() linux.ControllerInfo {
+	return d.hci.ControllerInfo()
 }
 
 func (d *device) Connect(p Peripheral) {
-	d.hci.Connect(p.(*peripheral).pd)
+	if err := d.hci.Connect(p.(*peripheral).pd); err != nil {
+		log.Printf("can't connect: %s", err)
+	}
+}
+
+func (d *device) Dial(ctx context.Context, addr string, t AddressType) (Peripheral, error) {
+	a, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	pd := &linux.PlatData{AddressType: uint8(t), Address: a}
+
+	c := make(chan Peripheral, 1)
+	d.dialmu.Lock()
+	d.dials[pd] = c
+	d.dialmu.Unlock()
+	defer func() {
+		d.dialmu.Lock()
+		delete(d.dials, pd)
+		d.dialmu.Unlock()
+	}()
+
+	if err := d.hci.Dial(ctx, pd); err != nil {
+		return nil, err
+	}
+	select {
+	case p := <-c:
+		if p == nil {
+			return nil, ErrDisconnected
+		}
+		return p, nil
+	case <-ctx.Done():
+		d.hci.CancelConnection(pd)
+		return nil, ctx.Err()
+	}
+}
+
+// parseAddr parses a device address in the form of "00:11:22:33:44:55".
+func parseAddr(addr string) ([6]byte, error) {
+	var b [6]byte
+	a, err := net.ParseMAC(addr)
+	if err != nil {
+		return b, err
+	}
+	if len(a) != 6 {
+		return b, fmt.Errorf("invalid address %s", addr)
+	}
+	copy(b[:], a)
+	return b, nil
+}
+
+// changeLists calls f, which modifies the accept list or the resolving list of the controller,
+// with the scan and the auto-connect suspended, as the lists can't be modified while in use.
+func (d *device) changeLists(f func() error) error {
+	if d.hci == nil {
+		return errors.New("device is not initialized")
+	}
+	d.scanmu.Lock()
+	defer d.scanmu.Unlock()
+	return d.suspendScan(f)
+}
+
+// suspendScan calls f with the scan and the auto-connect suspended.
+// It must be called with scanmu held.
+func (d *device) suspendScan(f func() error) error {
+	auto := d.autoCancel != nil
+	if auto {
+		d.stopAutoConnect()
+	}
+	if d.scanning {
+		d.stopScan()
+	}
+	err := f()
+	if d.scanning {
+		if serr := d.startScan(); err == nil {
+			err = serr
+		}
+	}
+	if auto {
+		d.startAutoConnect()
+	}
+	return err
+}
+
+// setAddressResolution sets whether resolvable private addresses are resolved by the controller,
+// with the IRKs of the peers, and the IRK of the device, if it uses resolvable private addresses.
+func (d *device) setAddressResolution(en bool) error {
+	return d.changeLists(func() error {
+		var local [16]byte
+		if d.own.irk != nil {
+			local = *d.own.irk
+		}
+		return d.hci.SetAddressResolution(en, local, d.own.rotate)
+	})
+}
+
+// startAutoConnect connects to the devices on the accept list in the background,
+// until stopAutoConnect is called. It must be called with scanmu held.
+func (d *device) startAutoConnect() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	d.autoCancel, d.autoDone = cancel, done
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			if _, err := d.hci.DialWhiteList(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("auto-connect: %s", err)
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+				}
+			}
+		}
+	}()
+}
+
+// stopAutoConnect stops the auto-connect, if any. It must be called with scanmu held.
+func (d *device) stopAutoConnect() {
+	if d.autoCancel == nil {
+		return
+	}
+	d.autoCancel()
+	<-d.autoDone
+	d.autoCancel, d.autoDone = nil, nil
 }
 
 func (d *device) CancelConnection(p Peripheral) {
@@ -216,12 +591,109 @@ func (d *device) SendHCIRawCommand(c cmd.CmdParam) ([]byte, error) {
 	return d.hci.SendRawCommand(c)
 }
 
+// advParams returns the advertising parameters to be sent to the device by update,
+// which are the ones last sent, unless set otherwise.
+func (d *device) advParams() *cmd.LESetAdvertisingParameters {
+	if d.advParam == nil {
+		p := d.advParamSent
+		d.advParam = &p
+	}
+	return d.advParam
+}
+
+// applyOwnAddress sets the own address of the device to o, which is
+// applied once the HCI device is opened, if it isn't yet.
+func (d *device) applyOwnAddress(o ownAddress) error {
+	if d.hci == nil {
+		d.own = o
+		return nil
+	}
+	return d.setOwnAddress(o)
+}
+
+// setOwnAddress sets the own address of the device to o, and applies it to advertising,
+// scanning and connecting. The resolvable private address, if any, is rotated until
+// the own address is set again.
+func (d *device) setOwnAddress(o ownAddress) error {
+	d.scanmu.Lock()
+	if d.rpaQuit != nil {
+		close(d.rpaQuit)
+		d.rpaQuit = nil
+	}
+	d.own = o
+	err := d.suspendScan(func() error {
+		if o.typ == 0x00 {
+			d.hci.SetOwnAddressType(o.typ)
+			return nil
+		}
+		a := o.static
+		if o.irk != nil {
+			var err error
+			if a, err = linux.NewResolvableAddress(*o.irk); err != nil {
+				return err
+			}
+		}
+		if err := d.hci.SetRandomAddress(a); err != nil {
+			return err
+		}
+		d.hci.SetOwnAddressType(o.typ)
+		return nil
+	})
+	if err == nil && o.irk != nil {
+		d.rpaQuit = make(chan struct{})
+		go d.rotateAddress(d.rpaQuit, *o.irk, o.rotate)
+	}
+	d.scanmu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Advertise with the new address type.
+	d.advParams()
+	return d.update()
+}
+
+// rotateAddress sets a new resolvable private address generated from k every interval, until quit is closed.
+func (d *device) rotateAddress(quit chan struct{}, k [16]byte, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-quit:
+			return
+		}
+		d.scanmu.Lock()
+		select {
+		case <-quit:
+			d.scanmu.Unlock()
+			return
+		default:
+		}
+		err := d.suspendScan(func() error {
+			a, err := linux.NewResolvableAddress(k)
+			if err != nil {
+				return err
+			}
+			return d.hci.SetRandomAddress(a)
+		})
+		d.scanmu.Unlock()
+		if err != nil {
+			log.Printf("can't rotate the resolvable private address: %s", err)
+		}
+	}
+}
+
 // Flush pending advertising settings to the device.
 func (d *device) update() error {
 	if d.advParam != nil {
+		d.scanmu.Lock()
+		d.advParam.OwnAddressType = d.own.typ
+		d.scanmu.Unlock()
 		if err := d.hci.SendCmdWithAdvOff(d.advParam); err != nil {
 			return err
 		}
+		d.advParamSent = *d.advParam
 		d.advParam = nil
 	}
 	if d.scanResp != nil {
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -15,6 +16,8 @@ import (
 
 var done = make(chan struct{})
 
+var asJSON = flag.Bool("json", false, "print the profile of the peripheral as JSON")
+
 func onStateChanged(d gatt.Device, s gatt.State) {
 	fmt.Println("State:", s)
 	switch s {
@@ -50,6 +53,17 @@ func onPeriphConnected(p gatt.Peripheral, err error) {
 	fmt.Println("Connected")
 	defer p.Device().CancelConnection(p)
 
+	if *asJSON {
+		pf, err := p.DiscoverProfile(true)
+		if err != nil {
+			fmt.Printf("Failed to discover profile, err: %s\n", err)
+			return
+		}
+		b, _ := json.MarshalIndent(pf, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+
 	// Discovery services
 	ss, err := p.DiscoverServices(nil)
 	if err != nil {
@@ -117,7 +131,7 @@ func onPeriphConnected(p gatt.Peripheral, err error) {
 }
 
 func onPeriphDisconnected(p gatt.Peripheral, err error) {
-	fmt.Println("Disconnected")
+	fmt.Println("Disconnected:", err)
 	close(done)
 }
 
@@ -0,0 +1,121 @@
+package linux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// A CaptureFormat is the file format of the HCI packets captured by SetCapture.
+type CaptureFormat int
+
+const (
+	// CaptureBTSnoop is the btsnoop format, with the HCI UART (H4) datalink.
+	CaptureBTSnoop CaptureFormat = iota
+
+	// CapturePCAP is the pcap format, with LINKTYPE_BLUETOOTH_HCI_H4_WITH_PHDR.
+	CapturePCAP
+)
+
+const (
+	btsnoopDatalinkH4   = 1002
+	btsnoopEpochOffset  = 0x00dcddb30f2f8000 // microseconds from 0000-01-01 to 1970-01-01
+	pcapLinktypeH4PHDR  = 201
+	pcapSnaplen         = 65535
+	pcapDirectionSent   = 0
+	pcapDirectionRecved = 1
+)
+
+// A capture writes the HCI packets, which start with the H4 packet type, to w.
+// A failed write stops the capture, without affecting the HCI.
+type capture struct {
+	mu *sync.Mutex
+	w  io.Writer
+	f  CaptureFormat
+}
+
+// start writes the file header of the format f to w, and starts capturing to it.
+// If w is nil, the capture is stopped.
+func (c *capture) start(w io.Writer, f CaptureFormat) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w = nil
+	if w == nil {
+		return nil
+	}
+	var h []byte
+	switch f {
+	case CaptureBTSnoop:
+		h = make([]byte, 16)
+		copy(h, "btsnoop\x00")
+		binary.BigEndian.PutUint32(h[8:], 1) // version
+		binary.BigEndian.PutUint32(h[12:], btsnoopDatalinkH4)
+	case CapturePCAP:
+		h = make([]byte, 24)
+		binary.LittleEndian.PutUint32(h, 0xa1b2c3d4)
+		binary.LittleEndian.PutUint16(h[4:], 2) // version major
+		binary.LittleEndian.PutUint16(h[6:], 4) // version minor
+		binary.LittleEndian.PutUint32(h[16:], pcapSnaplen)
+		binary.LittleEndian.PutUint32(h[20:], pcapLinktypeH4PHDR)
+	default:
+		return errors.New("unknown capture format")
+	}
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+	c.w, c.f = w, f
+	return nil
+}
+
+// packet writes the packet b, which is received from the controller if recv is set, to the capture.
+func (c *capture) packet(b []byte, recv bool, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w == nil || len(b) == 0 {
+		return
+	}
+	var r []byte
+	switch c.f {
+	case CaptureBTSnoop:
+		r = make([]byte, 24+len(b))
+		binary.BigEndian.PutUint32(r, uint32(len(b)))     // original length
+		binary.BigEndian.PutUint32(r[4:], uint32(len(b))) // included length
+		var flags uint32
+		if recv {
+			flags |= 0x01
+		}
+		if typ := packetType(b[0]); typ == typCommandPkt || typ == typEventPkt {
+			flags |= 0x02
+		}
+		binary.BigEndian.PutUint32(r[8:], flags)
+		binary.BigEndian.PutUint64(r[16:], uint64(t.UnixNano()/1000+btsnoopEpochOffset))
+		copy(r[24:], b)
+	case CapturePCAP:
+		n := 4 + len(b)
+		r = make([]byte, 16+n)
+		binary.LittleEndian.PutUint32(r, uint32(t.Unix()))
+		binary.LittleEndian.PutUint32(r[4:], uint32(t.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(r[8:], uint32(n))  // included length
+		binary.LittleEndian.PutUint32(r[12:], uint32(n)) // original length
+		dir := uint32(pcapDirectionSent)
+		if recv {
+			dir = pcapDirectionRecved
+		}
+		binary.BigEndian.PutUint32(r[16:], dir)
+		copy(r[20:], b)
+	}
+	if _, err := c.w.Write(r); err != nil {
+		log.Printf("hci: capture stopped: %v", err)
+		c.w = nil
+	}
+}
+
+// SetCapture starts capturing all the HCI packets sent to and received from
+// the controller to w, in the format f. A previous capture, if any, is stopped.
+// If w is nil, the capture is stopped.
+func (h *HCI) SetCapture(w io.Writer, f CaptureFormat) error {
+	return h.d.(*device).cap.start(w, f)
+}
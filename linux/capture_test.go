@@ -0,0 +1,97 @@
+package linux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 678901000, time.UTC)
+	cmd := []byte{0x01, 0x03, 0x0c, 0x00}                   // HCI Reset
+	evt := []byte{0x04, 0x0e, 0x04, 0x01, 0x03, 0x0c, 0x00} // Command Complete
+	acl := []byte{0x02, 0x40, 0x20, 0x00, 0x00}
+
+	var buf bytes.Buffer
+	c := &capture{mu: &sync.Mutex{}}
+	if err := c.start(&buf, CaptureBTSnoop); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	c.packet(cmd, false, ts)
+	c.packet(evt, true, ts)
+	c.packet(acl, true, ts)
+	b := buf.Bytes()
+	if !bytes.Equal(b[:8], []byte("btsnoop\x00")) || binary.BigEndian.Uint32(b[12:]) != btsnoopDatalinkH4 {
+		t.Fatalf("btsnoop header: got [% X]", b[:16])
+	}
+	b = b[16:]
+	for _, tt := range []struct {
+		pkt   []byte
+		flags uint32
+	}{
+		{cmd, 0x02}, // sent, command
+		{evt, 0x03}, // received, event
+		{acl, 0x01}, // received, data
+	} {
+		n := binary.BigEndian.Uint32(b)
+		if n != uint32(len(tt.pkt)) || binary.BigEndian.Uint32(b[4:]) != n {
+			t.Fatalf("btsnoop length: got %d want %d", n, len(tt.pkt))
+		}
+		if f := binary.BigEndian.Uint32(b[8:]); f != tt.flags {
+			t.Errorf("btsnoop flags: got 0x%X want 0x%X", f, tt.flags)
+		}
+		us := int64(binary.BigEndian.Uint64(b[16:])) - btsnoopEpochOffset
+		if got := time.Unix(0, us*1000).UTC(); !got.Equal(ts.Truncate(time.Microsecond)) {
+			t.Errorf("btsnoop timestamp: got %s want %s", got, ts)
+		}
+		if !bytes.Equal(b[24:24+n], tt.pkt) {
+			t.Errorf("btsnoop packet: got [% X] want [% X]", b[24:24+n], tt.pkt)
+		}
+		b = b[24+n:]
+	}
+
+	buf.Reset()
+	if err := c.start(&buf, CapturePCAP); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	c.packet(cmd, false, ts)
+	c.packet(evt, true, ts)
+	b = buf.Bytes()
+	if binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != pcapLinktypeH4PHDR {
+		t.Fatalf("pcap header: got [% X]", b[:24])
+	}
+	b = b[24:]
+	for _, tt := range []struct {
+		pkt []byte
+		dir uint32
+	}{
+		{cmd, pcapDirectionSent},
+		{evt, pcapDirectionRecved},
+	} {
+		sec, usec := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if got := time.Unix(int64(sec), int64(usec)*1000).UTC(); !got.Equal(ts.Truncate(time.Microsecond)) {
+			t.Errorf("pcap timestamp: got %s want %s", got, ts)
+		}
+		n := binary.LittleEndian.Uint32(b[8:])
+		if n != uint32(4+len(tt.pkt)) || binary.LittleEndian.Uint32(b[12:]) != n {
+			t.Fatalf("pcap length: got %d want %d", n, 4+len(tt.pkt))
+		}
+		if d := binary.BigEndian.Uint32(b[16:]); d != tt.dir {
+			t.Errorf("pcap direction: got %d want %d", d, tt.dir)
+		}
+		if !bytes.Equal(b[20:16+n], tt.pkt) {
+			t.Errorf("pcap packet: got [% X] want [% X]", b[20:16+n], tt.pkt)
+		}
+		b = b[16+n:]
+	}
+
+	// A stopped capture writes nothing.
+	buf.Reset()
+	c.start(nil, CapturePCAP)
+	c.packet(cmd, false, ts)
+	if buf.Len() != 0 {
+		t.Errorf("stopped capture: got [% X]", buf.Bytes())
+	}
+}
@@ -2,10 +2,12 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"time"
 
 	"github.com/paypal/gatt/linux/evt"
 	"github.com/paypal/gatt/linux/util"
@@ -17,10 +19,22 @@ type CmdParam interface {
 	Len() int
 }
 
+// A CmdTimeout is implemented by the commands which take longer, or shorter,
+// than DefaultTimeout for the controller to respond to, such as vendor commands.
+type CmdTimeout interface {
+	Timeout() time.Duration
+}
+
+// DefaultTimeout is how long the controller has to respond to a command, once it's sent.
+const DefaultTimeout = 2 * time.Second
+
+// ErrTimeout is returned by Send if the controller doesn't respond to a command in time.
+var ErrTimeout = errors.New("hci: command timed out")
+
 func NewCmd(d io.Writer) *Cmd {
 	c := &Cmd{
 		dev:     d,
-		sent:    []*cmdPkt{},
+		queue:   make(chan *cmdPkt),
 		compc:   make(chan evt.CommandCompleteEP),
 		statusc: make(chan evt.CommandStatusEP),
 	}
@@ -29,9 +43,21 @@ func NewCmd(d io.Writer) *Cmd {
 }
 
 type cmdPkt struct {
-	op   int
-	cp   CmdParam
-	done chan []byte
+	op       int
+	cp       CmdParam
+	timeout  time.Duration
+	deadline time.Time
+	done     chan cmdResult
+
+	// expired is set once the command has timed out after it was sent.
+	// It's then kept as a tombstone, for another timeout, to absorb a late response.
+	expired bool
+}
+
+// A cmdResult is the response to a cmdPkt, or the error of sending it.
+type cmdResult struct {
+	rsp []byte
+	err error
 }
 
 func (c cmdPkt) Marshal() []byte {
@@ -44,14 +70,18 @@ func (c cmdPkt) Marshal() []byte {
 	return b
 }
 
+// A Cmd sends commands to the controller, and delivers the responses to the senders.
+// The commands are queued, and sent in order, as long as the controller has
+// the credits, i.e. the Num_HCI_Command_Packets of the last Command Complete
+// or Command Status event, to accept them. It's safe for concurrent use.
 type Cmd struct {
 	dev     io.Writer
-	sent    []*cmdPkt
+	queue   chan *cmdPkt
 	compc   chan evt.CommandCompleteEP
 	statusc chan evt.CommandStatusEP
 }
 
-func (c Cmd) trace(fmt string, v ...interface{}) {}
+func (c *Cmd) trace(fmt string, v ...interface{}) {}
 
 func (c *Cmd) HandleComplete(b []byte) error {
 	var e evt.CommandCompleteEP
@@ -71,20 +101,24 @@ func (c *Cmd) HandleStatus(b []byte) error {
 	return nil
 }
 
+// Send queues the command cp, and waits for the controller to respond to it.
+// The response is the return parameters of a Command Complete event, or the
+// status of a Command Status event, both of which start with the status.
+// ErrTimeout is returned if there is no response within the timeout of cp,
+// which includes the time cp is queued, waiting for the credits.
 func (c *Cmd) Send(cp CmdParam) ([]byte, error) {
-	op := cp.Opcode()
-	p := &cmdPkt{op: op, cp: cp, done: make(chan []byte)}
-	raw := p.Marshal()
-
-	c.sent = append(c.sent, p)
-	if n, err := c.dev.Write(raw); err != nil {
-		return nil, err
-	} else if n != len(raw) {
-		return nil, errors.New("Failed to send whole Cmd pkt to HCI socket")
+	d := DefaultTimeout
+	if t, ok := cp.(CmdTimeout); ok {
+		d = t.Timeout()
 	}
-	return <-p.done, nil
+	p := &cmdPkt{op: cp.Opcode(), cp: cp, timeout: d, deadline: time.Now().Add(d), done: make(chan cmdResult, 1)}
+	c.queue <- p
+	r := <-p.done
+	return r.rsp, r.err
 }
 
+// SendAndCheckResp sends the command cp, and checks the status of the response
+// is one of exp, if any is specified. An unexpected status is returned as an Error.
 func (c *Cmd) SendAndCheckResp(cp CmdParam, exp []byte) error {
 	rsp, err := c.Send(cp)
 	if err != nil {
@@ -94,42 +128,150 @@ func (c *Cmd) SendAndCheckResp(cp CmdParam, exp []byte) error {
 	if len(exp) == 0 {
 		return nil
 	}
+	if len(rsp) == 0 {
+		return fmt.Errorf("HCI command: '0x%04x' returned no status", cp.Opcode())
+	}
 	// Check the if status is one of the expected value
 	if !bytes.Contains(exp, rsp[0:1]) {
-		return fmt.Errorf("HCI command: '0x%04x' return 0x%02X, expect: [%X] ", cp.Opcode(), rsp[0], exp)
+		if rsp[0] == 0x00 {
+			return fmt.Errorf("HCI command: '0x%04x' return 0x%02X, expect: [%X] ", cp.Opcode(), rsp[0], exp)
+		}
+		return Error(rsp[0])
 	}
 	return nil
 }
 
+// write writes p to the device.
+func (c *Cmd) write(p *cmdPkt) error {
+	raw := p.Marshal()
+	if n, err := c.dev.Write(raw); err != nil {
+		return err
+	} else if n != len(raw) {
+		return errors.New("Failed to send whole Cmd pkt to HCI socket")
+	}
+	return nil
+}
+
+// complete delivers the response rsp to the command of opcode op that was sent first,
+// and returns the commands still waiting for the responses.
+// A tombstone of an expired command absorbs the response instead, as it's late.
+// Opcode 0x0000 only updates the credits, and matches no command.
+func complete(sent []*cmdPkt, op uint16, rsp []byte) ([]*cmdPkt, bool) {
+	if op == 0x0000 {
+		return sent, true
+	}
+	for i, p := range sent {
+		if uint16(p.op) == op {
+			if !p.expired {
+				p.done <- cmdResult{rsp: rsp}
+			}
+			return append(sent[:i], sent[i+1:]...), true
+		}
+	}
+	return sent, false
+}
+
+// expire fails the commands in ps which have passed the deadline with ErrTimeout,
+// and returns the rest. If tomb is set, the expired commands are kept as tombstones
+// until they pass the deadline again.
+func expire(ps []*cmdPkt, now time.Time, tomb bool) []*cmdPkt {
+	s := ps[:0]
+	for _, p := range ps {
+		if now.Before(p.deadline) {
+			s = append(s, p)
+			continue
+		}
+		if p.expired {
+			continue
+		}
+		p.done <- cmdResult{err: ErrTimeout}
+		if tomb {
+			p.expired = true
+			p.deadline = now.Add(p.timeout)
+			s = append(s, p)
+		}
+	}
+	return s
+}
+
+// earliest returns the earliest deadline of the commands in pss, if any.
+func earliest(pss ...[]*cmdPkt) (time.Time, bool) {
+	var d time.Time
+	for _, ps := range pss {
+		for _, p := range ps {
+			if d.IsZero() || p.deadline.Before(d) {
+				d = p.deadline
+			}
+		}
+	}
+	return d, !d.IsZero()
+}
+
 func (c *Cmd) processCmdEvents() {
+	credits := 1          // The controller accepts one command after reset.
+	var pending []*cmdPkt // queued, waiting for the credits to be sent.
+	var sent []*cmdPkt    // sent, waiting for the responses.
+
+	// t fires at the earliest deadline of the commands, pending or sent, if armed.
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	var armed bool
+	var at time.Time
 	for {
-		select {
-		case status := <-c.statusc:
-			found := false
-			for i, p := range c.sent {
-				if uint16(p.op) == status.CommandOpcode {
-					found = true
-					c.sent = append(c.sent[:i], c.sent[i+1:]...)
-					close(p.done)
-					break
+		for credits > 0 && len(pending) > 0 {
+			p := pending[0]
+			pending = pending[1:]
+			if err := c.write(p); err != nil {
+				p.done <- cmdResult{err: err}
+				continue
+			}
+			credits--
+			sent = append(sent, p)
+		}
+
+		d, ok := earliest(pending, sent)
+		if armed && (!ok || !d.Equal(at)) {
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
 				}
 			}
-			if !found {
+			armed = false
+		}
+		if ok && !armed {
+			t.Reset(time.Until(d))
+			armed, at = true, d
+		}
+		var timeout <-chan time.Time
+		if armed {
+			timeout = t.C
+		}
+
+		select {
+		case p := <-c.queue:
+			pending = append(pending, p)
+		case status := <-c.statusc:
+			credits = int(status.NumHCICommandPackets)
+			var ok bool
+			if sent, ok = complete(sent, status.CommandOpcode, []byte{status.Status}); !ok {
 				log.Printf("Can't find the cmdPkt for this CommandStatusEP: %v", status)
 			}
 		case comp := <-c.compc:
-			found := false
-			for i, p := range c.sent {
-				if uint16(p.op) == comp.CommandOPCode {
-					found = true
-					c.sent = append(c.sent[:i], c.sent[i+1:]...)
-					p.done <- comp.ReturnParameters
-					break
-				}
-			}
-			if !found {
+			credits = int(comp.NumHCICommandPackets)
+			var ok bool
+			if sent, ok = complete(sent, comp.CommandOPCode, comp.ReturnParameters); !ok {
 				log.Printf("Can't find the cmdPkt for this CommandCompleteEP: %v", comp)
 			}
+		case now := <-timeout:
+			armed = false
+			pending = expire(pending, now, false)
+			sent = expire(sent, now, true)
+			// The controller may never return the credit of a lost command,
+			// or may have returned no credit with nothing in flight.
+			if credits == 0 {
+				credits = 1
+			}
 		}
 	}
 }
@@ -305,6 +447,14 @@ const (
 	opReadDataBlockSize           = infoParam<<10 | 0x000A // Read Data Block Size
 	opReadLocalSupportedCodecs    = infoParam<<10 | 0x000B // Read Local Supported Codecs
 )
+const (
+	opReadFailedContactCounter  = statusParam<<10 | 0x0001 // Read Failed Contact Counter
+	opResetFailedContactCounter = statusParam<<10 | 0x0002 // Reset Failed Contact Counter
+	opReadLinkQuality           = statusParam<<10 | 0x0003 // Read Link Quality
+	opReadRSSI                  = statusParam<<10 | 0x0005 // Read RSSI
+	opReadAFHChannelMap         = statusParam<<10 | 0x0006 // Read AFH Channel Map
+	opReadClock                 = statusParam<<10 | 0x0007 // Read Clock
+)
 const (
 	opLESetEventMask                      = leCtl<<10 | 0x0001 // LE Set Event Mask
 	opLEReadBufferSize                    = leCtl<<10 | 0x0002 // LE Read Buffer Size
@@ -338,6 +488,12 @@ const (
 	opLETestEnd                           = leCtl<<10 | 0x001f // LE Test End
 	opLERemoteConnectionParameterReply    = leCtl<<10 | 0x0020 // LE Remote Connection Parameter Request Reply
 	opLERemoteConnectionParameterNegReply = leCtl<<10 | 0x0021 // LE Remote Connection Parameter Request Negative Reply
+	opLEAddDeviceToResolvingList          = leCtl<<10 | 0x0027 // LE Add Device To Resolving List
+	opLERemoveDeviceFromResolvingList     = leCtl<<10 | 0x0028 // LE Remove Device From Resolving List
+	opLEClearResolvingList                = leCtl<<10 | 0x0029 // LE Clear Resolving List
+	opLESetAddressResolutionEnable        = leCtl<<10 | 0x002d // LE Set Address Resolution Enable
+	opLESetRPATimeout                     = leCtl<<10 | 0x002e // LE Set Resolvable Private Address Timeout
+	opLEReadMaxAdvDataLength              = leCtl<<10 | 0x003a // LE Read Maximum Advertising Data Length
 )
 
 var o = util.Order
@@ -512,6 +668,92 @@ func (c WriteLEHostSupported) Marshal(b []byte) { b[0], b[1] = c.LESupportedHost
 
 type WriteLeHostSupportedRP struct{ Status uint8 }
 
+// Informational Parameters Commands
+
+// Read Local Version Information (0x0001)
+type ReadLocalVersionInformation struct{}
+
+func (c ReadLocalVersionInformation) Opcode() int      { return opReadLocalVersionInformation }
+func (c ReadLocalVersionInformation) Len() int         { return 0 }
+func (c ReadLocalVersionInformation) Marshal(b []byte) {}
+
+type ReadLocalVersionInformationRP struct {
+	Status           uint8
+	HCIVersion       uint8
+	HCIRevision      uint16
+	LMPPALVersion    uint8
+	ManufacturerName uint16
+	LMPPALSubversion uint16
+}
+
+func (r *ReadLocalVersionInformationRP) Unmarshal(b []byte) error { return unmarshal(b, r) }
+
+// Read Local Supported Commands (0x0002)
+type ReadLocalSupportedCommands struct{}
+
+func (c ReadLocalSupportedCommands) Opcode() int      { return opReadLocalSupportedCommands }
+func (c ReadLocalSupportedCommands) Len() int         { return 0 }
+func (c ReadLocalSupportedCommands) Marshal(b []byte) {}
+
+type ReadLocalSupportedCommandsRP struct {
+	Status            uint8
+	SupportedCommands [64]byte
+}
+
+func (r *ReadLocalSupportedCommandsRP) Unmarshal(b []byte) error { return unmarshal(b, r) }
+
+// Read Buffer Size (0x0005)
+type ReadBufferSize struct{}
+
+func (c ReadBufferSize) Opcode() int      { return opReadBufferSize }
+func (c ReadBufferSize) Len() int         { return 0 }
+func (c ReadBufferSize) Marshal(b []byte) {}
+
+type ReadBufferSizeRP struct {
+	Status                           uint8
+	HCACLDataPacketLength            uint16
+	HCSynchronousDataPacketLength    uint8
+	HCTotalNumACLDataPackets         uint16
+	HCTotalNumSynchronousDataPackets uint16
+}
+
+func (r *ReadBufferSizeRP) Unmarshal(b []byte) error { return unmarshal(b, r) }
+
+// Read BD_ADDR (0x0009)
+type ReadBDADDR struct{}
+
+func (c ReadBDADDR) Opcode() int      { return opReadBDADDR }
+func (c ReadBDADDR) Len() int         { return 0 }
+func (c ReadBDADDR) Marshal(b []byte) {}
+
+type ReadBDADDRRP struct {
+	Status uint8
+	BDADDR [6]byte
+}
+
+func (r *ReadBDADDRRP) Unmarshal(b []byte) error {
+	if len(b) < 7 {
+		return io.ErrUnexpectedEOF
+	}
+	r.Status, r.BDADDR = b[0], o.MAC(b[1:])
+	return nil
+}
+
+// Status Parameters Commands
+
+// Read RSSI (0x0005)
+type ReadRSSI struct{ ConnectionHandle uint16 }
+
+func (c ReadRSSI) Opcode() int      { return opReadRSSI }
+func (c ReadRSSI) Len() int         { return 2 }
+func (c ReadRSSI) Marshal(b []byte) { o.PutUint16(b, c.ConnectionHandle) }
+
+type ReadRSSIRP struct {
+	Status           uint8
+	ConnectionHandle uint16
+	RSSI             int8
+}
+
 // LE Controller Commands
 
 // LE Set Event Mask (0x0001)
@@ -527,7 +769,7 @@ type LESetEventMaskRP struct{ Status uint8 }
 type LEReadBufferSize struct{}
 
 func (c LEReadBufferSize) Opcode() int      { return opLEReadBufferSize }
-func (c LEReadBufferSize) Len() int         { return 1 }
+func (c LEReadBufferSize) Len() int         { return 0 }
 func (c LEReadBufferSize) Marshal(b []byte) {}
 
 type LEReadBufferSizeRP struct {
@@ -536,6 +778,8 @@ type LEReadBufferSizeRP struct {
 	HCTotalNumLEACLDataPackets uint8
 }
 
+func (r *LEReadBufferSizeRP) Unmarshal(b []byte) error { return unmarshal(b, r) }
+
 // LE Read Local Supported Features (0x0003)
 type LEReadLocalSupportedFeatures struct{}
 
@@ -548,6 +792,8 @@ type LEReadLocalSupportedFeaturesRP struct {
 	LEFeatures uint64
 }
 
+func (r *LEReadLocalSupportedFeaturesRP) Unmarshal(b []byte) error { return unmarshal(b, r) }
+
 // LE Set Random Address (0x0005)
 type LESetRandomAddress struct{ RandomAddress [6]byte }
 
@@ -993,3 +1239,84 @@ type LERemoteConnectionParameterNegReplyRP struct {
 	Status           uint8
 	ConnectionHandle uint16
 }
+
+// LE Add Device To Resolving List (0x0027)
+// The IRKs are in the little-endian order, as sent to the controller.
+type LEAddDeviceToResolvingList struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+	PeerIRK                 [16]byte
+	LocalIRK                [16]byte
+}
+
+func (c LEAddDeviceToResolvingList) Opcode() int { return opLEAddDeviceToResolvingList }
+func (c LEAddDeviceToResolvingList) Len() int    { return 39 }
+func (c LEAddDeviceToResolvingList) Marshal(b []byte) {
+	b[0] = c.PeerIdentityAddressType
+	o.PutMAC(b[1:], c.PeerIdentityAddress)
+	copy(b[7:], c.PeerIRK[:])
+	copy(b[23:], c.LocalIRK[:])
+}
+
+type LEAddDeviceToResolvingListRP struct{ Status uint8 }
+
+// LE Remove Device From Resolving List (0x0028)
+type LERemoveDeviceFromResolvingList struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+}
+
+func (c LERemoveDeviceFromResolvingList) Opcode() int { return opLERemoveDeviceFromResolvingList }
+func (c LERemoveDeviceFromResolvingList) Len() int    { return 7 }
+func (c LERemoveDeviceFromResolvingList) Marshal(b []byte) {
+	b[0] = c.PeerIdentityAddressType
+	o.PutMAC(b[1:], c.PeerIdentityAddress)
+}
+
+type LERemoveDeviceFromResolvingListRP struct{ Status uint8 }
+
+// LE Clear Resolving List (0x0029)
+type LEClearResolvingList struct{}
+
+func (c LEClearResolvingList) Opcode() int      { return opLEClearResolvingList }
+func (c LEClearResolvingList) Len() int         { return 0 }
+func (c LEClearResolvingList) Marshal(b []byte) {}
+
+type LEClearResolvingListRP struct{ Status uint8 }
+
+// LE Set Address Resolution Enable (0x002D)
+type LESetAddressResolutionEnable struct{ AddressResolutionEnable uint8 }
+
+func (c LESetAddressResolutionEnable) Opcode() int      { return opLESetAddressResolutionEnable }
+func (c LESetAddressResolutionEnable) Len() int         { return 1 }
+func (c LESetAddressResolutionEnable) Marshal(b []byte) { b[0] = c.AddressResolutionEnable }
+
+type LESetAddressResolutionEnableRP struct{ Status uint8 }
+
+// LE Set Resolvable Private Address Timeout (0x002E)
+type LESetResolvablePrivateAddressTimeout struct{ RPATimeout uint16 }
+
+func (c LESetResolvablePrivateAddressTimeout) Opcode() int      { return opLESetRPATimeout }
+func (c LESetResolvablePrivateAddressTimeout) Len() int         { return 2 }
+func (c LESetResolvablePrivateAddressTimeout) Marshal(b []byte) { o.PutUint16(b, c.RPATimeout) }
+
+type LESetResolvablePrivateAddressTimeoutRP struct{ Status uint8 }
+
+// LE Read Maximum Advertising Data Length (0x003A)
+type LEReadMaxAdvDataLength struct{}
+
+func (c LEReadMaxAdvDataLength) Opcode() int      { return opLEReadMaxAdvDataLength }
+func (c LEReadMaxAdvDataLength) Len() int         { return 0 }
+func (c LEReadMaxAdvDataLength) Marshal(b []byte) {}
+
+type LEReadMaxAdvDataLengthRP struct {
+	Status                   uint8
+	MaxAdvertisingDataLength uint16
+}
+
+func (r *LEReadMaxAdvDataLengthRP) Unmarshal(b []byte) error { return unmarshal(b, r) }
+
+// unmarshal decodes the return parameters b into the fixed-size struct rp.
+func unmarshal(b []byte, rp interface{}) error {
+	return binary.Read(bytes.NewReader(b), binary.LittleEndian, rp)
+}
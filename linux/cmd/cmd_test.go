@@ -0,0 +1,192 @@
+package cmd
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolvingListCmds(t *testing.T) {
+	irk := [16]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	local := [16]byte{0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9, 0xfa, 0xfb, 0xfc, 0xfd, 0xfe, 0xff}
+	addr := [6]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	cases := []struct {
+		c      CmdParam
+		opcode int
+		want   []byte
+	}{
+		{
+			LEAddDeviceToResolvingList{PeerIdentityAddressType: 0x01, PeerIdentityAddress: addr, PeerIRK: irk, LocalIRK: local},
+			0x2027,
+			append(append([]byte{0x01, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11}, irk[:]...), local[:]...),
+		},
+		{
+			LERemoveDeviceFromResolvingList{PeerIdentityAddressType: 0x00, PeerIdentityAddress: addr},
+			0x2028,
+			[]byte{0x00, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11},
+		},
+		{LEClearResolvingList{}, 0x2029, []byte{}},
+		{LESetAddressResolutionEnable{AddressResolutionEnable: 1}, 0x202D, []byte{0x01}},
+		{LESetResolvablePrivateAddressTimeout{RPATimeout: 0x0384}, 0x202E, []byte{0x84, 0x03}},
+	}
+	for _, tt := range cases {
+		b := make([]byte, tt.c.Len())
+		tt.c.Marshal(b)
+		if tt.c.Opcode() != tt.opcode || !bytes.Equal(b, tt.want) {
+			t.Errorf("%T: got 0x%04X [% X] want 0x%04X [% X]", tt.c, tt.c.Opcode(), b, tt.opcode, tt.want)
+		}
+	}
+}
+
+// statusWriter responds to every command written to it with a Command Status of status.
+type statusWriter struct {
+	c      *Cmd
+	status uint8
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	go w.c.HandleStatus([]byte{w.status, 0x01, b[1], b[2]})
+	return len(b), nil
+}
+
+func TestCmdStatus(t *testing.T) {
+	w := &statusWriter{status: 0x0C}
+	w.c = NewCmd(w)
+	rsp, err := w.c.Send(LECreateConnCancel{})
+	if err != nil || !bytes.Equal(rsp, []byte{0x0C}) {
+		t.Errorf("Send: got [% X], %v want [0C], nil", rsp, err)
+	}
+	if err := w.c.SendAndCheckResp(LECreateConnCancel{}, []byte{0x00}); err != ErrCommandDisallowed {
+		t.Errorf("SendAndCheckResp: got %v want %v", err, ErrCommandDisallowed)
+	}
+	if s := ErrInvalidParams.Error(); s != "hci: invalid HCI command parameters" {
+		t.Errorf("Error: got %q", s)
+	}
+
+	c := NewCmd(&bytes.Buffer{}) // Never responds.
+	if _, err := c.Send(timeoutCmd{}); err != ErrTimeout {
+		t.Errorf("Send: got %v want %v", err, ErrTimeout)
+	}
+}
+
+// timeoutCmd is a vendor command with a short timeout.
+type timeoutCmd struct{}
+
+func (c timeoutCmd) Opcode() int            { return 0xFC01 }
+func (c timeoutCmd) Len() int               { return 0 }
+func (c timeoutCmd) Marshal(b []byte)       {}
+func (c timeoutCmd) Timeout() time.Duration { return 10 * time.Millisecond }
+
+// lateCmd is a vendor command whose responses the test delivers itself.
+type lateCmd struct{}
+
+func (c lateCmd) Opcode() int            { return 0xFC02 }
+func (c lateCmd) Len() int               { return 0 }
+func (c lateCmd) Marshal(b []byte)       {}
+func (c lateCmd) Timeout() time.Duration { return 100 * time.Millisecond }
+
+// chanWriter passes every command written to it to the test.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- b
+	return len(b), nil
+}
+
+func TestCmdLateComplete(t *testing.T) {
+	w := make(chanWriter, 2)
+	c := NewCmd(w)
+	if _, err := c.Send(lateCmd{}); err != ErrTimeout {
+		t.Fatalf("Send: got %v want %v", err, ErrTimeout)
+	}
+	<-w
+
+	type result struct {
+		rsp []byte
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		rsp, err := c.Send(lateCmd{})
+		done <- result{rsp, err}
+	}()
+	<-w
+	// The response to the expired command arrives late, before the one to the next command.
+	c.HandleComplete([]byte{0x01, 0x02, 0xFC, 0x00, 0xAA})
+	c.HandleComplete([]byte{0x01, 0x02, 0xFC, 0x00, 0xBB})
+	if r := <-done; r.err != nil || !bytes.Equal(r.rsp, []byte{0x00, 0xBB}) {
+		t.Errorf("Send: got [% X], %v want [00 BB], nil", r.rsp, r.err)
+	}
+}
+
+// creditWriter completes every command written to it with the opcode as the return parameters,
+// and counts the commands sent without the credits.
+type creditWriter struct {
+	c        *Cmd
+	mu       sync.Mutex
+	inflight int
+	overrun  int
+}
+
+func (w *creditWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	w.inflight++
+	if w.inflight > 1 {
+		w.overrun++
+	}
+	w.mu.Unlock()
+	go func() {
+		time.Sleep(time.Millisecond)
+		w.mu.Lock()
+		w.inflight--
+		w.mu.Unlock()
+		w.c.HandleComplete([]byte{0x01, b[1], b[2], 0x00, b[1], b[2]})
+	}()
+	return len(b), nil
+}
+
+func TestCmdQueue(t *testing.T) {
+	w := &creditWriter{}
+	w.c = NewCmd(w)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(c CmdParam) {
+			defer wg.Done()
+			rsp, err := w.c.Send(c)
+			op := c.Opcode()
+			if err != nil || !bytes.Equal(rsp, []byte{0x00, byte(op), byte(op >> 8)}) {
+				t.Errorf("Send(0x%04X): got [% X], %v", op, rsp, err)
+			}
+		}([]CmdParam{LESetScanEnable{}, LESetAdvertiseEnable{}}[i%2])
+	}
+	wg.Wait()
+	if w.overrun != 0 {
+		t.Errorf("%d commands sent without the credits", w.overrun)
+	}
+}
+
+// zeroWriter completes every command written to it, and returns no credit.
+type zeroWriter struct{ c *Cmd }
+
+func (w *zeroWriter) Write(b []byte) (int, error) {
+	go w.c.HandleComplete([]byte{0x00, b[1], b[2], 0x00})
+	return len(b), nil
+}
+
+func TestCmdNoCredits(t *testing.T) {
+	w := &zeroWriter{}
+	w.c = NewCmd(w)
+	if _, err := w.c.Send(LESetScanEnable{}); err != nil {
+		t.Fatalf("Send: got %v want nil", err)
+	}
+	// The command is never sent, as there is no credit, and times out in the queue.
+	if _, err := w.c.Send(timeoutCmd{}); err != ErrTimeout {
+		t.Errorf("Send: got %v want %v", err, ErrTimeout)
+	}
+	// The credit is recovered once it has timed out.
+	if _, err := w.c.Send(LESetScanEnable{}); err != nil {
+		t.Errorf("Send: got %v want nil", err)
+	}
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import "fmt"
+
+// An Error is an HCI error code, as reported by the controller in the status
+// of a command, or the reason of a disconnection.
+// The codes are defined in the Bluetooth Core specification, Vol 2, Part D.
+type Error uint8
+
+// Error codes of the Bluetooth Core specification.
+const (
+	ErrUnknownCommand                Error = 0x01 // Unknown HCI Command
+	ErrUnknownConnID                 Error = 0x02 // Unknown Connection Identifier
+	ErrHardwareFailure               Error = 0x03 // Hardware Failure
+	ErrPageTimeout                   Error = 0x04 // Page Timeout
+	ErrAuthFailure                   Error = 0x05 // Authentication Failure
+	ErrPinOrKeyMissing               Error = 0x06 // PIN or Key Missing
+	ErrMemoryCapacity                Error = 0x07 // Memory Capacity Exceeded
+	ErrConnTimeout                   Error = 0x08 // Connection Timeout
+	ErrConnLimit                     Error = 0x09 // Connection Limit Exceeded
+	ErrSyncConnLimit                 Error = 0x0A // Synchronous Connection Limit To A Device Exceeded
+	ErrConnExists                    Error = 0x0B // Connection Already Exists
+	ErrCommandDisallowed             Error = 0x0C // Command Disallowed
+	ErrRejectedLimitedResources      Error = 0x0D // Connection Rejected due to Limited Resources
+	ErrRejectedSecurity              Error = 0x0E // Connection Rejected Due To Security Reasons
+	ErrRejectedBDAddr                Error = 0x0F // Connection Rejected due to Unacceptable BD_ADDR
+	ErrConnAcceptTimeout             Error = 0x10 // Connection Accept Timeout Exceeded
+	ErrUnsupportedFeature            Error = 0x11 // Unsupported Feature or Parameter Value
+	ErrInvalidParams                 Error = 0x12 // Invalid HCI Command Parameters
+	ErrRemoteUser                    Error = 0x13 // Remote User Terminated Connection
+	ErrRemoteLowResources            Error = 0x14 // Remote Device Terminated Connection due to Low Resources
+	ErrRemotePowerOff                Error = 0x15 // Remote Device Terminated Connection due to Power Off
+	ErrLocalHost                     Error = 0x16 // Connection Terminated By Local Host
+	ErrRepeatedAttempts              Error = 0x17 // Repeated Attempts
+	ErrPairingNotAllowed             Error = 0x18 // Pairing Not Allowed
+	ErrUnknownLMPPDU                 Error = 0x19 // Unknown LMP PDU
+	ErrUnsupportedRemoteFeature      Error = 0x1A // Unsupported Remote Feature / Unsupported LMP Feature
+	ErrSCOOffsetRejected             Error = 0x1B // SCO Offset Rejected
+	ErrSCOIntervalRejected           Error = 0x1C // SCO Interval Rejected
+	ErrSCOAirModeRejected            Error = 0x1D // SCO Air Mode Rejected
+	ErrInvalidLLParams               Error = 0x1E // Invalid LMP Parameters / Invalid LL Parameters
+	ErrUnspecified                   Error = 0x1F // Unspecified Error
+	ErrUnsupportedLLParam            Error = 0x20 // Unsupported LMP Parameter Value / Unsupported LL Parameter Value
+	ErrRoleChangeNotAllowed          Error = 0x21 // Role Change Not Allowed
+	ErrLLResponseTimeout             Error = 0x22 // LMP Response Timeout / LL Response Timeout
+	ErrLLCollision                   Error = 0x23 // LMP Error Transaction Collision / LL Procedure Collision
+	ErrLMPPDUNotAllowed              Error = 0x24 // LMP PDU Not Allowed
+	ErrEncryptionModeNotAcceptable   Error = 0x25 // Encryption Mode Not Acceptable
+	ErrLinkKeyCannotChange           Error = 0x26 // Link Key cannot be Changed
+	ErrQoSNotSupported               Error = 0x27 // Requested QoS Not Supported
+	ErrInstantPassed                 Error = 0x28 // LMP PDU / LL Procedure Instant Passed
+	ErrUnitKeyNotSupported           Error = 0x29 // Pairing With Unit Key Not Supported
+	ErrDifferentTransactionCollision Error = 0x2A // Different Transaction Collision
+	ErrQoSUnacceptableParam          Error = 0x2C // QoS Unacceptable Parameter
+	ErrQoSRejected                   Error = 0x2D // QoS Rejected
+	ErrChannelClassNotSupported      Error = 0x2E // Channel Classification Not Supported
+	ErrInsufficientSecurity          Error = 0x2F // Insufficient Security
+	ErrParamOutOfRange               Error = 0x30 // Parameter Out Of Mandatory Range
+	ErrRoleSwitchPending             Error = 0x32 // Role Switch Pending
+	ErrReservedSlotViolation         Error = 0x34 // Reserved Slot Violation
+	ErrRoleSwitchFailed              Error = 0x35 // Role Switch Failed
+	ErrEIRTooLarge                   Error = 0x36 // Extended Inquiry Response Too Large
+	ErrSSPNotSupported               Error = 0x37 // Secure Simple Pairing Not Supported By Host
+	ErrHostBusyPairing               Error = 0x38 // Host Busy - Pairing
+	ErrNoSuitableChannel             Error = 0x39 // Connection Rejected due to No Suitable Channel Found
+	ErrControllerBusy                Error = 0x3A // Controller Busy
+	ErrUnacceptableConnParams        Error = 0x3B // Unacceptable Connection Parameters
+	ErrAdvertisingTimeout            Error = 0x3C // Advertising Timeout
+	ErrMICFailure                    Error = 0x3D // Connection Terminated due to MIC Failure
+	ErrConnFailedToEstablish         Error = 0x3E // Connection Failed to be Established
+	ErrCoarseClockAdjRejected        Error = 0x40 // Coarse Clock Adjustment Rejected but Will Try to Adjust Using Clock Dragging
+	ErrType0SubmapNotDefined         Error = 0x41 // Type0 Submap Not Defined
+	ErrUnknownAdvID                  Error = 0x42 // Unknown Advertising Identifier
+	ErrLimitReached                  Error = 0x43 // Limit Reached
+	ErrCancelledByHost               Error = 0x44 // Operation Cancelled by Host
+	ErrPacketTooLong                 Error = 0x45 // Packet Too Long
+)
+
+var errName = map[Error]string{
+	ErrUnknownCommand:                "unknown HCI command",
+	ErrUnknownConnID:                 "unknown connection identifier",
+	ErrHardwareFailure:               "hardware failure",
+	ErrPageTimeout:                   "page timeout",
+	ErrAuthFailure:                   "authentication failure",
+	ErrPinOrKeyMissing:               "PIN or key missing",
+	ErrMemoryCapacity:                "memory capacity exceeded",
+	ErrConnTimeout:                   "connection timeout",
+	ErrConnLimit:                     "connection limit exceeded",
+	ErrSyncConnLimit:                 "synchronous connection limit to a device exceeded",
+	ErrConnExists:                    "connection already exists",
+	ErrCommandDisallowed:             "command disallowed",
+	ErrRejectedLimitedResources:      "connection rejected due to limited resources",
+	ErrRejectedSecurity:              "connection rejected due to security reasons",
+	ErrRejectedBDAddr:                "connection rejected due to unacceptable BD_ADDR",
+	ErrConnAcceptTimeout:             "connection accept timeout exceeded",
+	ErrUnsupportedFeature:            "unsupported feature or parameter value",
+	ErrInvalidParams:                 "invalid HCI command parameters",
+	ErrRemoteUser:                    "remote user terminated connection",
+	ErrRemoteLowResources:            "remote device terminated connection due to low resources",
+	ErrRemotePowerOff:                "remote device terminated connection due to power off",
+	ErrLocalHost:                     "connection terminated by local host",
+	ErrRepeatedAttempts:              "repeated attempts",
+	ErrPairingNotAllowed:             "pairing not allowed",
+	ErrUnknownLMPPDU:                 "unknown LMP PDU",
+	ErrUnsupportedRemoteFeature:      "unsupported remote feature",
+	ErrSCOOffsetRejected:             "SCO offset rejected",
+	ErrSCOIntervalRejected:           "SCO interval rejected",
+	ErrSCOAirModeRejected:            "SCO air mode rejected",
+	ErrInvalidLLParams:               "invalid LL parameters",
+	ErrUnspecified:                   "unspecified error",
+	ErrUnsupportedLLParam:            "unsupported LL parameter value",
+	ErrRoleChangeNotAllowed:          "role change not allowed",
+	ErrLLResponseTimeout:             "LL response timeout",
+	ErrLLCollision:                   "LL procedure collision",
+	ErrLMPPDUNotAllowed:              "LMP PDU not allowed",
+	ErrEncryptionModeNotAcceptable:   "encryption mode not acceptable",
+	ErrLinkKeyCannotChange:           "link key cannot be changed",
+	ErrQoSNotSupported:               "requested QoS not supported",
+	ErrInstantPassed:                 "LL procedure instant passed",
+	ErrUnitKeyNotSupported:           "pairing with unit key not supported",
+	ErrDifferentTransactionCollision: "different transaction collision",
+	ErrQoSUnacceptableParam:          "QoS unacceptable parameter",
+	ErrQoSRejected:                   "QoS rejected",
+	ErrChannelClassNotSupported:      "channel classification not supported",
+	ErrInsufficientSecurity:          "insufficient security",
+	ErrParamOutOfRange:               "parameter out of mandatory range",
+	ErrRoleSwitchPending:             "role switch pending",
+	ErrReservedSlotViolation:         "reserved slot violation",
+	ErrRoleSwitchFailed:              "role switch failed",
+	ErrEIRTooLarge:                   "extended inquiry response too large",
+	ErrSSPNotSupported:               "secure simple pairing not supported by host",
+	ErrHostBusyPairing:               "host busy - pairing",
+	ErrNoSuitableChannel:             "connection rejected due to no suitable channel found",
+	ErrControllerBusy:                "controller busy",
+	ErrUnacceptableConnParams:        "unacceptable connection parameters",
+	ErrAdvertisingTimeout:            "advertising timeout",
+	ErrMICFailure:                    "connection terminated due to MIC failure",
+	ErrConnFailedToEstablish:         "connection failed to be established",
+	ErrCoarseClockAdjRejected:        "coarse clock adjustment rejected",
+	ErrType0SubmapNotDefined:         "type0 submap not defined",
+	ErrUnknownAdvID:                  "unknown advertising identifier",
+	ErrLimitReached:                  "limit reached",
+	ErrCancelledByHost:               "operation cancelled by host",
+	ErrPacketTooLong:                 "packet too long",
+}
+
+func (e Error) Error() string {
+	if s, ok := errName[e]; ok {
+		return "hci: " + s
+	}
+	return fmt.Sprintf("hci: error 0x%02X", uint8(e))
+}
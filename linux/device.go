@@ -5,6 +5,7 @@ import (
 	"log"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/paypal/gatt/linux/gioctl"
@@ -17,6 +18,7 @@ type device struct {
 	name string
 	rmu  *sync.Mutex
 	wmu  *sync.Mutex
+	cap  *capture
 }
 
 func newDevice(n int, chk bool) (*device, error) {
@@ -89,19 +91,28 @@ func newSocket(fd, n int, chk bool) (*device, error) {
 		name: name,
 		rmu:  &sync.Mutex{},
 		wmu:  &sync.Mutex{},
+		cap:  &capture{mu: &sync.Mutex{}},
 	}, nil
 }
 
 func (d device) Read(b []byte) (int, error) {
 	d.rmu.Lock()
 	defer d.rmu.Unlock()
-	return syscall.Read(d.fd, b)
+	n, err := syscall.Read(d.fd, b)
+	if n > 0 {
+		d.cap.packet(b[:n], true, time.Now())
+	}
+	return n, err
 }
 
 func (d device) Write(b []byte) (int, error) {
 	d.wmu.Lock()
 	defer d.wmu.Unlock()
-	return syscall.Write(d.fd, b)
+	n, err := syscall.Write(d.fd, b)
+	if n > 0 {
+		d.cap.packet(b[:n], false, time.Now())
+	}
+	return n, err
 }
 
 func (d device) Close() error {
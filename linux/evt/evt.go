@@ -134,6 +134,7 @@ const (
 	LEReadRemoteUsedFeaturesComplete               = 0x04 // LE Read Remote Used Features Complete
 	LELTKRequest                                   = 0x05 // LE LTK Request
 	LERemoteConnectionParameterRequest             = 0x06 // LE Remote Connection Parameter Request
+	LEEnhancedConnectionComplete                   = 0x0A // LE Enhanced Connection Complete
 )
 
 type EventHeader struct {
@@ -281,6 +282,42 @@ func (e *LEConnectionCompleteEP) Unmarshal(b []byte) error {
 	return nil
 }
 
+// LEEnhancedConnectionCompleteEP is reported instead of LEConnectionCompleteEP, once enabled in the LE event mask.
+// If the peer address is resolved by the controller, PeerAddressType is 0x02 or 0x03, and PeerAddress is the identity address.
+type LEEnhancedConnectionCompleteEP struct {
+	SubeventCode                  uint8
+	Status                        uint8
+	ConnectionHandle              uint16
+	Role                          uint8
+	PeerAddressType               uint8
+	PeerAddress                   [6]byte
+	LocalResolvablePrivateAddress [6]byte
+	PeerResolvablePrivateAddress  [6]byte
+	ConnInterval                  uint16
+	ConnLatency                   uint16
+	SupervisionTimeout            uint16
+	MasterClockAccuracy           uint8
+}
+
+func (e *LEEnhancedConnectionCompleteEP) Unmarshal(b []byte) error {
+	if len(b) < 31 {
+		return errors.New("malformed LE enhanced connection complete event")
+	}
+	e.SubeventCode = o.Uint8(b[0:])
+	e.Status = o.Uint8(b[1:])
+	e.ConnectionHandle = o.Uint16(b[2:])
+	e.Role = o.Uint8(b[4:])
+	e.PeerAddressType = o.Uint8(b[5:])
+	e.PeerAddress = o.MAC(b[6:])
+	e.LocalResolvablePrivateAddress = o.MAC(b[12:])
+	e.PeerResolvablePrivateAddress = o.MAC(b[18:])
+	e.ConnInterval = o.Uint16(b[24:])
+	e.ConnLatency = o.Uint16(b[26:])
+	e.SupervisionTimeout = o.Uint16(b[28:])
+	e.MasterClockAccuracy = o.Uint8(b[30:])
+	return nil
+}
+
 type LEAdvertisingReportEP struct {
 	SubeventCode uint8
 	NumReports   uint8
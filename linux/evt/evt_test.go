@@ -0,0 +1,43 @@
+package evt
+
+import "testing"
+
+func TestLEEnhancedConnectionComplete(t *testing.T) {
+	b := []byte{
+		0x0a,       // subevent code
+		0x00,       // status
+		0x40, 0x00, // connection handle
+		0x01,                               // role: slave
+		0x03,                               // peer address type: resolved random identity
+		0x66, 0x55, 0x44, 0x33, 0x22, 0x11, // peer address
+		0x06, 0x05, 0x04, 0x03, 0x02, 0x41, // local resolvable private address
+		0xaa, 0xfb, 0x0d, 0x94, 0x81, 0x70, // peer resolvable private address
+		0x18, 0x00, // connection interval
+		0x01, 0x00, // connection latency
+		0xc8, 0x00, // supervision timeout
+		0x05, // master clock accuracy
+	}
+	var e LEEnhancedConnectionCompleteEP
+	if err := e.Unmarshal(b); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := LEEnhancedConnectionCompleteEP{
+		SubeventCode:                  0x0a,
+		ConnectionHandle:              0x0040,
+		Role:                          0x01,
+		PeerAddressType:               0x03,
+		PeerAddress:                   [6]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66},
+		LocalResolvablePrivateAddress: [6]byte{0x41, 0x02, 0x03, 0x04, 0x05, 0x06},
+		PeerResolvablePrivateAddress:  [6]byte{0x70, 0x81, 0x94, 0x0d, 0xfb, 0xaa},
+		ConnInterval:                  0x0018,
+		ConnLatency:                   0x0001,
+		SupervisionTimeout:            0x00c8,
+		MasterClockAccuracy:           0x05,
+	}
+	if e != want {
+		t.Errorf("Unmarshal: got %+v want %+v", e, want)
+	}
+	if err := e.Unmarshal(b[:30]); err == nil {
+		t.Errorf("Unmarshal: expected an error for a short event")
+	}
+}
@@ -1,10 +1,12 @@
 package linux
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/paypal/gatt/linux/cmd"
 	"github.com/paypal/gatt/linux/evt"
@@ -15,6 +17,11 @@ type HCI struct {
 	AcceptSlaveHandler   func(pd *PlatData)
 	AdvertisementHandler func(pd *PlatData)
 
+	// ConnParamsHandler, if set, is called when the controller reports the
+	// completion of an update of the parameters of the connection to pd.
+	// ConnIntervalMin and ConnIntervalMax are both set to the connection interval in use.
+	ConnParamsHandler func(pd *PlatData, p ConnParams, err error)
+
 	d io.ReadWriteCloser
 	c *cmd.Cmd
 	e *evt.Evt
@@ -22,8 +29,44 @@ type HCI struct {
 	plist   map[bdaddr]*PlatData
 	plistmu *sync.Mutex
 
+	// passive reports whether the scan is passive, and gets no scan responses.
+	// It's guarded by plistmu.
+	passive bool
+
+	// dial is the connection being established by Dial, if any.
+	// The controller allows only one LE Create Connection at a time.
+	// dialing holds a token while a connection is being initiated.
+	dial    *dial
+	dialmu  *sync.Mutex
+	dialing chan struct{}
+
+	// irks are the IRKs of the peers, by their identity addresses.
+	// If resolving is set, they're also loaded into the resolving list of the
+	// controller, along with localIRK. The changes of the resolving list are
+	// serialized by listing, and sent without holding irksmu.
+	irks      map[bdaddr]IRK
+	resolving bool
+	localIRK  [16]byte
+	irksmu    *sync.Mutex
+	listing   *sync.Mutex
+
+	// connParams are the parameters of the connections initiated by Connect and Dial,
+	// and ownAddrType is the type of the address they're initiated with.
+	connParams   ConnParams
+	ownAddrType  uint8
+	connParamsmu *sync.Mutex
+
+	// info is read from the controller at startup, and bufCnt and bufSize
+	// are sized from its ACL buffers, if it reports them. ready is closed
+	// once they're set, before the packets that depend on them are handled.
+	info    ControllerInfo
 	bufCnt  chan struct{}
 	bufSize int
+	ready   chan struct{}
+
+	// pkts counts the ACL packets of each connection that the controller has yet to complete.
+	pkts   map[uint16]int
+	pktsmu *sync.Mutex
 
 	maxConn int
 	connsmu *sync.Mutex
@@ -35,6 +78,41 @@ type HCI struct {
 
 type bdaddr [6]byte
 
+// ConnParams are the parameters of an LE connection, in the units of the controller.
+type ConnParams struct {
+	ConnIntervalMin    uint16 // N x 1.25ms
+	ConnIntervalMax    uint16 // N x 1.25ms
+	ConnLatency        uint16 // Number of connection events
+	SupervisionTimeout uint16 // N x 10ms
+	MinimumCELength    uint16 // N x 0.625ms
+	MaximumCELength    uint16 // N x 0.625ms
+}
+
+// DefaultConnParams are the parameters used by Connect and Dial, unless set otherwise.
+var DefaultConnParams = ConnParams{
+	ConnIntervalMin:    0x0006, // 7.5ms
+	ConnIntervalMax:    0x0006, // 7.5ms
+	ConnLatency:        0x0000, //
+	SupervisionTimeout: 0x000A, // 100ms
+	MinimumCELength:    0x0000, //
+	MaximumCELength:    0x0000, //
+}
+
+// A dial is an outstanding LE Create Connection issued by Dial or DialWhiteList.
+type dial struct {
+	pd   *PlatData
+	errc chan error
+
+	// wl is set if the connection is to any device on the white list, instead of pd.
+	wl bool
+
+	// Once the connection is established, it's either accepted, and passed to the
+	// AcceptSlaveHandler, or, if the dial is abandoned first, disconnected.
+	// Both are guarded by dialmu.
+	accepted  bool
+	abandoned bool
+}
+
 type PlatData struct {
 	Name        string
 	AddressType uint8
@@ -43,14 +121,30 @@ type PlatData struct {
 	Connectable bool
 	RSSI        int8
 
+	// Resolved reports whether Address is a resolvable private address, which
+	// is resolved to IdentityAddress and IdentityAddressType with an IRK of the HCI.
+	Resolved            bool
+	IdentityAddressType uint8
+	IdentityAddress     [6]byte
+
 	Conn io.ReadWriteCloser
 }
 
 func NewHCI(devID int, chk bool, maxConn int) (*HCI, error) {
+	return NewHCICapture(devID, chk, maxConn, nil, CaptureBTSnoop)
+}
+
+// NewHCICapture works as NewHCI does, and captures all the HCI packets to w, in the format f,
+// from the initialization of the HCI device on. If w is nil, nothing is captured.
+func NewHCICapture(devID int, chk bool, maxConn int, w io.Writer, f CaptureFormat) (*HCI, error) {
 	d, err := newDevice(devID, chk)
 	if err != nil {
 		return nil, err
 	}
+	if err := d.cap.start(w, f); err != nil {
+		d.Close()
+		return nil, err
+	}
 	c := cmd.NewCmd(d)
 	e := evt.NewEvt()
 
@@ -62,8 +156,22 @@ func NewHCI(devID int, chk bool, maxConn int) (*HCI, error) {
 		plist:   make(map[bdaddr]*PlatData),
 		plistmu: &sync.Mutex{},
 
+		dialmu:  &sync.Mutex{},
+		dialing: make(chan struct{}, 1),
+
+		irks:    map[bdaddr]IRK{},
+		irksmu:  &sync.Mutex{},
+		listing: &sync.Mutex{},
+
+		connParams:   DefaultConnParams,
+		connParamsmu: &sync.Mutex{},
+
 		bufCnt:  make(chan struct{}, 15-1),
 		bufSize: 27,
+		ready:   make(chan struct{}),
+
+		pkts:   map[uint16]int{},
+		pktsmu: &sync.Mutex{},
 
 		maxConn: maxConn,
 		connsmu: &sync.Mutex{},
@@ -80,6 +188,10 @@ func NewHCI(devID int, chk bool, maxConn int) (*HCI, error) {
 
 	go h.mainLoop()
 	h.resetDevice()
+	if err := h.readInfo(); err != nil {
+		log.Printf("hci: failed to read the controller information: %v", err)
+	}
+	close(h.ready)
 	return h, nil
 }
 
@@ -109,15 +221,35 @@ func (h *HCI) setAdvertiseEnable(en bool) error {
 		}, []byte{0x00})
 }
 
+// SendCmdWithAdvOff sends the command c with advertising disabled, and checks its status.
 func (h *HCI) SendCmdWithAdvOff(c cmd.CmdParam) error {
 	h.setAdvertiseEnable(false)
-	err := h.c.SendAndCheckResp(c, nil)
+	err := h.c.SendAndCheckResp(c, []byte{0x00})
 	if h.adv {
 		h.setAdvertiseEnable(true)
 	}
 	return err
 }
 
+// AddToWhiteList adds the device of the address and address type to the white list.
+// The white list can't be modified while it's in use by scanning or connecting,
+// which are to be disabled first. Advertising is disabled by AddToWhiteList.
+func (h *HCI) AddToWhiteList(typ uint8, addr [6]byte) error {
+	return h.SendCmdWithAdvOff(cmd.LEAddDeviceToWhiteList{AddressType: typ, Address: addr})
+}
+
+// RemoveFromWhiteList removes the device of the address and address type from the white list.
+// It has the same restrictions as AddToWhiteList.
+func (h *HCI) RemoveFromWhiteList(typ uint8, addr [6]byte) error {
+	return h.SendCmdWithAdvOff(cmd.LERemoveDeviceFromWhiteList{AddressType: typ, Address: addr})
+}
+
+// ClearWhiteList removes all the devices from the white list.
+// It has the same restrictions as AddToWhiteList.
+func (h *HCI) ClearWhiteList() error {
+	return h.SendCmdWithAdvOff(cmd.LEClearWhiteList{})
+}
+
 func (h *HCI) SetScanEnable(en bool, dup bool) error {
 	return h.c.SendAndCheckResp(
 		cmd.LESetScanEnable{
@@ -126,22 +258,348 @@ func (h *HCI) SetScanEnable(en bool, dup bool) error {
 		}, []byte{0x00})
 }
 
+// SetScanParameters sets the parameters of LE scanning.
+// It fails if the controller is scanning.
+func (h *HCI) SetScanParameters(c cmd.LESetScanParameters) error {
+	if err := h.c.SendAndCheckResp(c, []byte{0x00}); err != nil {
+		return err
+	}
+	h.plistmu.Lock()
+	h.passive = c.LEScanType == 0x00
+	h.plistmu.Unlock()
+	return nil
+}
+
+// Connect starts connecting to the peer specified by pd, and returns once the
+// controller has accepted the command. The connection, once established, is
+// passed to the AcceptSlaveHandler. It waits for a pending Dial, if any.
 func (h *HCI) Connect(pd *PlatData) error {
-	h.c.Send(
-		cmd.LECreateConn{
-			LEScanInterval:        0x0004,     // N x 0.625ms
-			LEScanWindow:          0x0004,     // N x 0.625ms
-			InitiatorFilterPolicy: 0x00,       // white list not used
-			PeerAddressType:       0x00,       // public
-			PeerAddress:           pd.Address, //
-			OwnAddressType:        0x00,       // public
-			ConnIntervalMin:       0x0006,     // N x 0.125ms
-			ConnIntervalMax:       0x0006,     // N x 0.125ms
-			ConnLatency:           0x0000,     //
-			SupervisionTimeout:    0x000A,     // N x 10ms
-			MinimumCELength:       0x0000,     // N x 0.625ms
-			MaximumCELength:       0x0000,     // N x 0.625ms
-		})
+	if err := h.acquireDial(context.Background()); err != nil {
+		return err
+	}
+	defer h.releaseDial()
+	rsp, err := h.c.Send(h.createConn(pd))
+	if err != nil {
+		return err
+	}
+	if len(rsp) > 0 && rsp[0] != 0x00 {
+		return cmd.Error(rsp[0])
+	}
+	return nil
+}
+
+// Dial connects to the peer specified by the Address and AddressType of pd,
+// which doesn't have to be discovered by scanning first.
+// It blocks until the connection is established, fails, or ctx is done, in
+// which case the connection attempt is cancelled with LE Create Connection Cancel.
+// Once connected, pd.Conn is set and pd is passed to the AcceptSlaveHandler.
+func (h *HCI) Dial(ctx context.Context, pd *PlatData) error {
+	return h.dialWith(ctx, &dial{pd: pd, errc: make(chan error, 1)})
+}
+
+// DialWhiteList connects to whichever device on the white list is found first.
+// Otherwise, it works as Dial does, and returns the PlatData of the connected device.
+func (h *HCI) DialWhiteList(ctx context.Context) (*PlatData, error) {
+	d := &dial{pd: &PlatData{}, errc: make(chan error, 1), wl: true}
+	if err := h.dialWith(ctx, d); err != nil {
+		return nil, err
+	}
+	return d.pd, nil
+}
+
+// acquireDial waits until no other connection is being initiated, or ctx is done.
+func (h *HCI) acquireDial(ctx context.Context) error {
+	select {
+	case h.dialing <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *HCI) releaseDial() { <-h.dialing }
+
+func (h *HCI) dialWith(ctx context.Context, d *dial) error {
+	if err := h.acquireDial(ctx); err != nil {
+		return err
+	}
+	defer h.releaseDial()
+
+	h.dialmu.Lock()
+	h.dial = d
+	h.dialmu.Unlock()
+	defer func() {
+		h.dialmu.Lock()
+		h.dial = nil
+		h.dialmu.Unlock()
+	}()
+
+	c := h.createConn(d.pd)
+	if d.wl {
+		c.InitiatorFilterPolicy = 0x01 // white list used, peer address ignored
+	}
+	rsp, err := h.c.Send(c)
+	if err != nil {
+		return err
+	}
+	if len(rsp) > 0 && rsp[0] != 0x00 {
+		return cmd.Error(rsp[0])
+	}
+
+	select {
+	case err := <-d.errc:
+		return err
+	case <-ctx.Done():
+	}
+	h.dialmu.Lock()
+	accepted := d.accepted
+	d.abandoned = !accepted
+	h.dialmu.Unlock()
+	if accepted {
+		return <-d.errc
+	}
+
+	// The controller reports the cancellation with an LE Connection Complete,
+	// unless the connection has been established, or has failed, in the meantime,
+	// in which case the cancellation is disallowed, and the LE Connection Complete
+	// may have been reported already.
+	rsp, err = h.c.Send(cmd.LECreateConnCancel{})
+	if err == nil && len(rsp) > 0 && rsp[0] != 0x00 {
+		err = cmd.Error(rsp[0])
+	}
+	if err != nil && err != cmd.ErrCommandDisallowed {
+		log.Printf("hci: failed to cancel the connection: %v", err)
+	}
+	t := time.NewTimer(dialCancelTimeout)
+	defer t.Stop()
+	select {
+	case <-d.errc:
+	case <-t.C:
+	}
+	return ctx.Err()
+}
+
+// leEventMask enables LE Connection Complete, LE Advertising Report, LE Connection Update Complete,
+// LE Read Remote Features Complete and LE Long Term Key Request, and leEventMaskEnhanced also
+// enables LE Enhanced Connection Complete, which is reported instead of LE Connection Complete.
+const (
+	leEventMask         = 0x000000000000001F
+	leEventMaskEnhanced = leEventMask | 0x0000000000000200
+)
+
+// dialCancelTimeout is how long a cancelled Dial waits for the controller to report the outcome.
+const dialCancelTimeout = 2 * time.Second
+
+func (h *HCI) createConn(pd *PlatData) cmd.LECreateConn {
+	h.connParamsmu.Lock()
+	p, ownAddrType := h.connParams, h.ownAddrType
+	h.connParamsmu.Unlock()
+
+	// Peers on the resolving list are connected by their identity addresses.
+	peerAddrType := pd.AddressType
+	h.irksmu.Lock()
+	if _, ok := h.irks[pd.Address]; ok && h.resolving && peerAddrType < 0x02 {
+		peerAddrType += 0x02
+	}
+	h.irksmu.Unlock()
+
+	return cmd.LECreateConn{
+		LEScanInterval:        0x0004,               // N x 0.625ms
+		LEScanWindow:          0x0004,               // N x 0.625ms
+		InitiatorFilterPolicy: 0x00,                 // white list not used
+		PeerAddressType:       peerAddrType,         // 0x00: public, 0x01: random, 0x02, 0x03: resolved
+		PeerAddress:           pd.Address,           //
+		OwnAddressType:        ownAddrType,          // 0x00: public, 0x01: random
+		ConnIntervalMin:       p.ConnIntervalMin,    // N x 1.25ms
+		ConnIntervalMax:       p.ConnIntervalMax,    // N x 1.25ms
+		ConnLatency:           p.ConnLatency,        //
+		SupervisionTimeout:    p.SupervisionTimeout, // N x 10ms
+		MinimumCELength:       p.MinimumCELength,    // N x 0.625ms
+		MaximumCELength:       p.MaximumCELength,    // N x 0.625ms
+	}
+}
+
+// SetConnParams sets the parameters of the connections initiated by Connect and Dial.
+func (h *HCI) SetConnParams(p ConnParams) {
+	h.connParamsmu.Lock()
+	h.connParams = p
+	h.connParamsmu.Unlock()
+}
+
+// AddIRK adds the IRK of a peer, with which its resolvable private addresses
+// are resolved to its identity address, in advertisements and connections.
+// If the address resolution by the controller is enabled, the IRK is also added
+// to the resolving list, which has the same restrictions as the white list.
+func (h *HCI) AddIRK(k IRK) error {
+	h.listing.Lock()
+	defer h.listing.Unlock()
+	h.irksmu.Lock()
+	h.irks[k.Address] = k
+	resolving, c := h.resolving, h.addToResolvingList(k)
+	h.irksmu.Unlock()
+	if !resolving {
+		return nil
+	}
+	return h.changeResolvingList(c)
+}
+
+// RemoveIRK removes the IRK of the peer with the identity address addr.
+func (h *HCI) RemoveIRK(addr [6]byte) error {
+	h.listing.Lock()
+	defer h.listing.Unlock()
+	h.irksmu.Lock()
+	k, ok := h.irks[addr]
+	delete(h.irks, addr)
+	resolving := h.resolving
+	h.irksmu.Unlock()
+	if !ok || !resolving {
+		return nil
+	}
+	return h.changeResolvingList(cmd.LERemoveDeviceFromResolvingList{
+		PeerIdentityAddressType: k.AddressType,
+		PeerIdentityAddress:     k.Address,
+	})
+}
+
+// SetAddressResolution sets whether resolvable private addresses are resolved by the controller.
+// Once enabled, all the IRKs are loaded into the resolving list of the controller, along with
+// the local IRK, and the resolved peers are reported with their identity addresses.
+// The addresses the controller generates from the local IRK are rotated every rotate, if set.
+// It has the same restrictions as AddToWhiteList.
+func (h *HCI) SetAddressResolution(en bool, local [16]byte, rotate time.Duration) error {
+	h.listing.Lock()
+	defer h.listing.Unlock()
+	h.irksmu.Lock()
+	h.localIRK = local
+	if !en {
+		h.resolving = false
+		h.irksmu.Unlock()
+		if err := h.SendCmdWithAdvOff(cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 0}); err != nil {
+			return err
+		}
+		return h.SendCmdWithAdvOff(cmd.LESetEventMask{LEEventMask: leEventMask})
+	}
+	seq := []cmd.CmdParam{cmd.LEClearResolvingList{}}
+	for _, k := range h.irks {
+		seq = append(seq, h.addToResolvingList(k))
+	}
+	h.irksmu.Unlock()
+
+	if rotate > 0 {
+		if err := h.SendCmdWithAdvOff(rpaTimeout(rotate)); err != nil {
+			return err
+		}
+	}
+	if err := h.changeResolvingList(seq...); err != nil {
+		return err
+	}
+	// Report connections with LE Enhanced Connection Complete, which carries the resolved addresses.
+	if err := h.SendCmdWithAdvOff(cmd.LESetEventMask{LEEventMask: leEventMaskEnhanced}); err != nil {
+		return err
+	}
+	h.irksmu.Lock()
+	h.resolving = true
+	h.irksmu.Unlock()
+	return nil
+}
+
+// rpaTimeout returns the command, which sets the rotation interval of the resolvable private addresses
+// generated by the controller to d, in seconds from 1 to 0xA1B8 (about 11.5 hours).
+func rpaTimeout(d time.Duration) cmd.LESetResolvablePrivateAddressTimeout {
+	t := d / time.Second
+	if t < 0x0001 {
+		t = 0x0001
+	}
+	if t > 0xA1B8 {
+		t = 0xA1B8
+	}
+	return cmd.LESetResolvablePrivateAddressTimeout{RPATimeout: uint16(t)}
+}
+
+// changeResolvingList sends the commands, which modify the resolving list,
+// with the address resolution disabled, and then enables it.
+// It must be called with listing held.
+func (h *HCI) changeResolvingList(seq ...cmd.CmdParam) error {
+	seq = append([]cmd.CmdParam{cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 0}}, seq...)
+	seq = append(seq, cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 1})
+	for _, c := range seq {
+		if err := h.SendCmdWithAdvOff(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *HCI) addToResolvingList(k IRK) cmd.LEAddDeviceToResolvingList {
+	return cmd.LEAddDeviceToResolvingList{
+		PeerIdentityAddressType: k.AddressType,
+		PeerIdentityAddress:     k.Address,
+		PeerIRK:                 reverseKey(k.Key),
+		LocalIRK:                reverseKey(h.localIRK),
+	}
+}
+
+// resolve resolves the address of pd to an identity address, if it's a resolvable
+// private address, which is generated from one of the IRKs. The addresses of the types
+// 0x02 and 0x03 have been resolved by the controller, and are identity addresses already.
+func (h *HCI) resolve(pd *PlatData) {
+	if pd.AddressType == 0x02 || pd.AddressType == 0x03 {
+		pd.Resolved = true
+		pd.IdentityAddressType = pd.AddressType - 0x02
+		pd.IdentityAddress = pd.Address
+		return
+	}
+	if pd.Resolved || pd.AddressType != 0x01 || !IsResolvableAddress(pd.Address) {
+		return
+	}
+	h.irksmu.Lock()
+	defer h.irksmu.Unlock()
+	for _, k := range h.irks {
+		if ResolveAddress(k.Key, pd.Address) {
+			pd.Resolved = true
+			pd.IdentityAddressType = k.AddressType
+			pd.IdentityAddress = k.Address
+			return
+		}
+	}
+}
+
+// SetOwnAddressType sets the type of the address with which the connections are initiated by Connect and Dial.
+// 0x00: public, 0x01: random, as set by SetRandomAddress.
+func (h *HCI) SetOwnAddressType(t uint8) {
+	h.connParamsmu.Lock()
+	h.ownAddrType = t
+	h.connParamsmu.Unlock()
+}
+
+// SetRandomAddress sets the random address of the device, with advertising disabled.
+// The random address can't be set while scanning or connecting, which are to be disabled first.
+func (h *HCI) SetRandomAddress(a [6]byte) error {
+	return h.SendCmdWithAdvOff(cmd.LESetRandomAddress{RandomAddress: a})
+}
+
+// UpdateConnParams requests the controller to update the parameters of the connection to pd.
+// The ConnParamsHandler is called once the update completes.
+func (h *HCI) UpdateConnParams(pd *PlatData, p ConnParams) error {
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return fmt.Errorf("not connected")
+	}
+	rsp, err := h.c.Send(cmd.LEConnUpdate{
+		ConnectionHandle:   c.attr,
+		ConnIntervalMin:    p.ConnIntervalMin,
+		ConnIntervalMax:    p.ConnIntervalMax,
+		ConnLatency:        p.ConnLatency,
+		SupervisionTimeout: p.SupervisionTimeout,
+		MinimumCELength:    p.MinimumCELength,
+		MaximumCELength:    p.MaximumCELength,
+	})
+	if err != nil {
+		return err
+	}
+	if len(rsp) > 0 && rsp[0] != 0x00 {
+		return cmd.Error(rsp[0])
+	}
 	return nil
 }
 
@@ -149,8 +607,36 @@ func (h *HCI) CancelConnection(pd *PlatData) error {
 	return pd.Conn.Close()
 }
 
+// ReadRSSI reads the RSSI of the connection to pd from the controller.
+func (h *HCI) ReadRSSI(pd *PlatData) (int, error) {
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return 0, fmt.Errorf("not connected")
+	}
+	rsp, err := h.c.Send(cmd.ReadRSSI{ConnectionHandle: c.attr})
+	if err != nil {
+		return 0, err
+	}
+	if len(rsp) != 4 {
+		return 0, fmt.Errorf("malformed read rssi response [ % X ]", rsp)
+	}
+	if rsp[0] != 0x00 {
+		return 0, cmd.Error(rsp[0])
+	}
+	if h := uint16(rsp[1]) | uint16(rsp[2])<<8; h != c.attr {
+		return 0, fmt.Errorf("read rssi response for connection 0x%04X, not 0x%04X", h, c.attr)
+	}
+	return int(int8(rsp[3])), nil
+}
+
+// SendRawCommand sends the command c, and returns the response.
+// A non-zero status of the response is returned as a cmd.Error, along with the response.
 func (h *HCI) SendRawCommand(c cmd.CmdParam) ([]byte, error) {
-	return h.c.Send(c)
+	rsp, err := h.c.Send(c)
+	if err == nil && len(rsp) > 0 && rsp[0] != 0x00 {
+		err = cmd.Error(rsp[0])
+	}
+	return rsp, err
 }
 
 func btoi(b bool) uint8 {
@@ -178,6 +664,10 @@ func (h *HCI) mainLoop() {
 
 func (h *HCI) handlePacket(b []byte) {
 	t, b := packetType(b[0]), b[1:]
+	// Only the responses to the commands are handled at startup.
+	if t != typEventPkt || len(b) == 0 || (b[0] != evt.CommandComplete && b[0] != evt.CommandStatus) {
+		<-h.ready
+	}
 	var err error
 	switch t {
 	case typCommandPkt:
@@ -203,7 +693,7 @@ func (h *HCI) resetDevice() error {
 	seq := []cmd.CmdParam{
 		cmd.Reset{},
 		cmd.SetEventMask{EventMask: 0x3dbff807fffbffff},
-		cmd.LESetEventMask{LEEventMask: 0x000000000000001F},
+		cmd.LESetEventMask{LEEventMask: leEventMask},
 		cmd.WriteSimplePairingMode{SimplePairingMode: 1},
 		cmd.WriteLEHostSupported{LESupportedHost: 1, SimultaneousLEHost: 0},
 		cmd.WriteInquiryMode{InquiryMode: 2},
@@ -266,10 +756,13 @@ func (h *HCI) handleAdvertisement(b []byte) {
 			Connectable: connectable,
 			RSSI:        ep.RSSI[i],
 		}
+		h.resolve(pd)
 		h.plistmu.Lock()
 		h.plist[addr] = pd
+		passive := h.passive
 		h.plistmu.Unlock()
-		if scannable {
+		// The scannable advertisements are reported along with the scan responses, if any.
+		if scannable && !passive {
 			continue
 		}
 		h.AdvertisementHandler(pd)
@@ -281,21 +774,132 @@ func (h *HCI) handleNumberOfCompletedPkts(b []byte) error {
 	if err := ep.Unmarshal(b); err != nil {
 		return err
 	}
+	h.pktsmu.Lock()
+	defer h.pktsmu.Unlock()
 	for _, r := range ep.Packets {
-		for i := 0; i < int(r.NumOfCompletedPkts); i++ {
+		n, ok := h.pkts[r.ConnectionHandle]
+		if !ok {
+			continue // released on disconnection
+		}
+		if int(r.NumOfCompletedPkts) < n {
+			n = int(r.NumOfCompletedPkts)
+		}
+		h.pkts[r.ConnectionHandle] -= n
+		for i := 0; i < n; i++ {
 			<-h.bufCnt
 		}
 	}
 	return nil
 }
 
+// acquireBuf takes an ACL buffer of the controller for a packet of the connection hh,
+// blocking until one is available. It fails once the connection is disconnected.
+func (h *HCI) acquireBuf(hh uint16, donec chan struct{}) error {
+	select {
+	case h.bufCnt <- struct{}{}:
+	case <-donec:
+		return io.ErrClosedPipe
+	}
+	h.pktsmu.Lock()
+	defer h.pktsmu.Unlock()
+	if _, ok := h.pkts[hh]; !ok {
+		<-h.bufCnt
+		return io.ErrClosedPipe
+	}
+	h.pkts[hh]++
+	return nil
+}
+
+// releaseBufs releases the ACL buffers held by the packets of the disconnected connection hh;
+// the controller flushes them without reporting them completed.
+func (h *HCI) releaseBufs(hh uint16) {
+	h.pktsmu.Lock()
+	defer h.pktsmu.Unlock()
+	for i := 0; i < h.pkts[hh]; i++ {
+		<-h.bufCnt
+	}
+	delete(h.pkts, hh)
+}
+
 func (h *HCI) handleConnection(b []byte) {
 	ep := &evt.LEConnectionCompleteEP{}
 	if err := ep.Unmarshal(b); err != nil {
 		return // FIXME
 	}
+	h.connected(ep)
+}
+
+func (h *HCI) handleEnhancedConnection(b []byte) {
+	ee := &evt.LEEnhancedConnectionCompleteEP{}
+	if err := ee.Unmarshal(b); err != nil {
+		return
+	}
+	h.connected(&evt.LEConnectionCompleteEP{
+		SubeventCode:        ee.SubeventCode,
+		Status:              ee.Status,
+		ConnectionHandle:    ee.ConnectionHandle,
+		Role:                ee.Role,
+		PeerAddressType:     ee.PeerAddressType,
+		PeerAddress:         ee.PeerAddress,
+		ConnInterval:        ee.ConnInterval,
+		ConnLatency:         ee.ConnLatency,
+		SupervisionTimeout:  ee.SupervisionTimeout,
+		MasterClockAccuracy: ee.MasterClockAccuracy,
+	})
+}
+
+// connected handles the completion of a connection, either reported by LE Connection Complete,
+// or LE Enhanced Connection Complete, in which case the peer address may have been resolved by the controller.
+func (h *HCI) connected(ep *evt.LEConnectionCompleteEP) {
+
+	// Only a connection initiated by us can fail, or be cancelled.
+	var d *dial
+	if ep.Role == 0x00 {
+		h.dialmu.Lock()
+		d = h.dial
+		h.dialmu.Unlock()
+	}
+	if ep.Status != 0x00 {
+		if d != nil {
+			d.errc <- cmd.Error(ep.Status)
+		}
+		return
+	}
+
 	hh := ep.ConnectionHandle
 	c := newConn(h, hh)
+
+	var pd *PlatData
+	switch {
+	case ep.Role == 0x01: // master connection
+		pd = &PlatData{
+			AddressType: ep.PeerAddressType,
+			Address:     ep.PeerAddress,
+		}
+	case d != nil && d.wl:
+		pd = d.pd
+		pd.AddressType = ep.PeerAddressType
+		pd.Address = ep.PeerAddress
+	case d != nil && d.pd.Address == ep.PeerAddress:
+		pd = d.pd
+	default:
+		h.plistmu.Lock()
+		pd = h.plist[ep.PeerAddress]
+		h.plistmu.Unlock()
+		if pd == nil {
+			pd = &PlatData{
+				AddressType: ep.PeerAddressType,
+				Address:     ep.PeerAddress,
+			}
+		}
+	}
+	h.resolve(pd)
+	pd.Conn = c
+	c.pd = pd
+
+	h.pktsmu.Lock()
+	h.pkts[hh] = 0
+	h.pktsmu.Unlock()
 	h.connsmu.Lock()
 	h.conns[hh] = c
 	h.connsmu.Unlock()
@@ -307,19 +911,21 @@ func (h *HCI) handleConnection(b []byte) {
 		c.updateConnection()
 	}
 
-	// master connection
 	if ep.Role == 0x01 {
-		pd := &PlatData{
-			Address: ep.PeerAddress,
-			Conn:    c,
-		}
 		h.AcceptMasterHandler(pd)
 		return
 	}
-	h.plistmu.Lock()
-	pd := h.plist[ep.PeerAddress]
-	h.plistmu.Unlock()
-	pd.Conn = c
+	if d != nil && d.pd == pd {
+		h.dialmu.Lock()
+		abandoned := d.abandoned
+		d.accepted = !abandoned
+		h.dialmu.Unlock()
+		d.errc <- nil
+		if abandoned {
+			c.Close()
+			return
+		}
+	}
 	h.AcceptSlaveHandler(pd)
 }
 
@@ -338,25 +944,52 @@ func (h *HCI) handleDisconnectionComplete(b []byte) error {
 		return nil
 	}
 	delete(h.conns, hh)
-	close(c.aclc)
+	c.reason = cmd.Error(ep.Reason)
+	close(c.donec)
+	h.releaseBufs(hh)
 	h.setAdvertiseEnable(true)
 	return nil
 }
 
+func (h *HCI) handleConnUpdate(b []byte) {
+	ep := &evt.LEConnectionUpdateCompleteEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	h.connsmu.Lock()
+	c, found := h.conns[ep.ConnectionHandle]
+	h.connsmu.Unlock()
+	if !found || c.pd == nil || h.ConnParamsHandler == nil {
+		return
+	}
+	if ep.Status != 0x00 {
+		h.ConnParamsHandler(c.pd, ConnParams{}, cmd.Error(ep.Status))
+		return
+	}
+	h.ConnParamsHandler(c.pd, ConnParams{
+		ConnIntervalMin:    ep.ConnInterval,
+		ConnIntervalMax:    ep.ConnInterval,
+		ConnLatency:        ep.ConnLatency,
+		SupervisionTimeout: ep.SupervisionTimeout,
+	}, nil)
+}
+
 func (h *HCI) handleLEMeta(b []byte) error {
 	code := evt.LEEventCode(b[0])
 	switch code {
 	case evt.LEConnectionComplete:
 		go h.handleConnection(b)
+	case evt.LEEnhancedConnectionComplete:
+		go h.handleEnhancedConnection(b)
 	case evt.LEConnectionUpdateComplete:
-		// anything to do here?
+		go h.handleConnUpdate(b)
 	case evt.LEAdvertisingReport:
 		go h.handleAdvertisement(b)
 	// case evt.LEReadRemoteUsedFeaturesComplete:
 	// case evt.LELTKRequest:
 	// case evt.LERemoteConnectionParameterRequest:
 	default:
-		return fmt.Errorf("Unhandled LE event: %s, [ % X ]", code, b)
+		return fmt.Errorf("Unhandled LE event: 0x%02X, [ % X ]", code, b)
 	}
 	return nil
 }
@@ -367,9 +1000,9 @@ func (h *HCI) handleL2CAP(b []byte) error {
 		return err
 	}
 	h.connsmu.Lock()
-	defer h.connsmu.Unlock()
 	c, found := h.conns[a.attr]
 	if !found {
+		h.connsmu.Unlock()
 		// should not happen, just be cautious for now.
 		log.Printf("l2conn: got data for disconnected handle: 0x%04x", a.attr)
 		return nil
@@ -377,12 +1010,19 @@ func (h *HCI) handleL2CAP(b []byte) error {
 	cid := uint16(a.b[2]) | (uint16(a.b[3]) << 8)
 	if cid == 5 {
 		c.handleSignal(a)
+		h.connsmu.Unlock()
 		return nil
 	}
-	c.aclc <- a
+	h.connsmu.Unlock()
+
+	// A slow reader of the connection doesn't hold up the others.
+	select {
+	case c.aclc <- a:
+	case <-c.donec:
+	}
 	return nil
 }
 
 func (h *HCI) trace(fmt string, v ...interface{}) {
-	log.Printf(fmt, v)
+	log.Printf(fmt, v...)
 }
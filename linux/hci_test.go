@@ -0,0 +1,170 @@
+package linux
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt/linux/cmd"
+	"github.com/paypal/gatt/linux/evt"
+)
+
+func TestResolvingList(t *testing.T) {
+	h := &HCI{localIRK: [16]byte{0xf0, 15: 0xff}}
+	k := IRK{Key: [16]byte{0x00, 15: 0x0f}, AddressType: 0x01, Address: [6]byte{0xc0, 0x11, 0x22, 0x33, 0x44, 0x55}}
+	want := cmd.LEAddDeviceToResolvingList{
+		PeerIdentityAddressType: 0x01,
+		PeerIdentityAddress:     k.Address,
+		PeerIRK:                 [16]byte{0x0f, 15: 0x00}, // least significant octet first
+		LocalIRK:                [16]byte{0xff, 15: 0xf0},
+	}
+	if got := h.addToResolvingList(k); got != want {
+		t.Errorf("addToResolvingList: got %+v want %+v", got, want)
+	}
+
+	for _, tt := range []struct {
+		d    time.Duration
+		want uint16
+	}{
+		{15 * time.Minute, 900},
+		{500 * time.Millisecond, 1},
+		{24 * time.Hour, 0xA1B8},
+	} {
+		if got := rpaTimeout(tt.d).RPATimeout; got != tt.want {
+			t.Errorf("rpaTimeout(%s): got %d want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestPassiveScan(t *testing.T) {
+	h := &HCI{plist: map[bdaddr]*PlatData{}, plistmu: &sync.Mutex{}, irksmu: &sync.Mutex{}}
+	var got []*PlatData
+	h.AdvertisementHandler = func(pd *PlatData) { got = append(got, pd) }
+	report := []byte{
+		0x02,                               // subevent code: LE Advertising Report
+		0x01,                               // number of reports
+		advInd,                             // event type
+		0x00,                               // address type: public
+		0x55, 0x44, 0x33, 0x22, 0x11, 0x00, // address
+		0x03,             // data length
+		0x02, 0x01, 0x06, // flags
+		0xc4, // RSSI: -60
+	}
+
+	// An active scan waits for the scan response.
+	h.handleAdvertisement(report)
+	if len(got) != 0 {
+		t.Fatalf("active: got %d reports want 0", len(got))
+	}
+
+	h.passive = true
+	h.handleAdvertisement(report)
+	if len(got) != 1 {
+		t.Fatalf("passive: got %d reports want 1", len(got))
+	}
+	pd := got[0]
+	if pd.Address != [6]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55} || !pd.Connectable || pd.RSSI != -60 {
+		t.Errorf("passive: got %+v", pd)
+	}
+}
+
+func TestDialWait(t *testing.T) {
+	h := &HCI{dialing: make(chan struct{}, 1)}
+	if err := h.acquireDial(context.Background()); err != nil {
+		t.Fatalf("acquireDial: got %v want nil", err)
+	}
+	// Another dial waits no longer than its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.acquireDial(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquireDial: got %v want %v", err, context.DeadlineExceeded)
+	}
+	h.releaseDial()
+	if err := h.acquireDial(context.Background()); err != nil {
+		t.Errorf("acquireDial: got %v want nil", err)
+	}
+}
+
+// cmdRecorder completes every command written to it successfully, and records the opcodes.
+type cmdRecorder struct {
+	c   *cmd.Cmd
+	mu  sync.Mutex
+	ops []int
+}
+
+func (w *cmdRecorder) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	w.ops = append(w.ops, int(b[1])|int(b[2])<<8)
+	w.mu.Unlock()
+	go w.c.HandleComplete([]byte{0x01, b[1], b[2], 0x00})
+	return len(b), nil
+}
+
+func TestAbandonedDial(t *testing.T) {
+	for _, abandoned := range []bool{false, true} {
+		w := &cmdRecorder{}
+		w.c = cmd.NewCmd(w)
+		h := &HCI{
+			c:       w.c,
+			dialmu:  &sync.Mutex{},
+			plistmu: &sync.Mutex{},
+			irksmu:  &sync.Mutex{},
+			pkts:    map[uint16]int{},
+			pktsmu:  &sync.Mutex{},
+			conns:   map[uint16]*conn{},
+			connsmu: &sync.Mutex{},
+			advmu:   &sync.Mutex{},
+		}
+		accepted := false
+		h.AcceptSlaveHandler = func(pd *PlatData) { accepted = true }
+		d := &dial{pd: &PlatData{Address: [6]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}}, errc: make(chan error, 1), abandoned: abandoned}
+		h.dial = d
+
+		h.connected(&evt.LEConnectionCompleteEP{ConnectionHandle: 0x0040, PeerAddress: d.pd.Address})
+		if err := <-d.errc; err != nil {
+			t.Errorf("abandoned %t: got %v want nil", abandoned, err)
+		}
+		if accepted == abandoned || d.accepted == abandoned {
+			t.Errorf("abandoned %t: got accepted %t, %t", abandoned, accepted, d.accepted)
+		}
+		disconnected := false
+		w.mu.Lock()
+		for _, op := range w.ops {
+			disconnected = disconnected || op == cmd.Disconnect{}.Opcode()
+		}
+		w.mu.Unlock()
+		if disconnected != abandoned {
+			t.Errorf("abandoned %t: got disconnected %t", abandoned, disconnected)
+		}
+	}
+}
+
+// rssiWriter completes every Read RSSI command written to it with the RSSI of -60 for handle.
+type rssiWriter struct {
+	c      *cmd.Cmd
+	handle uint16
+}
+
+func (w *rssiWriter) Write(b []byte) (int, error) {
+	go w.c.HandleComplete([]byte{0x01, b[1], b[2], 0x00, byte(w.handle), byte(w.handle >> 8), 0xc4})
+	return len(b), nil
+}
+
+func TestReadRSSI(t *testing.T) {
+	for _, tt := range []struct {
+		handle uint16
+		ok     bool
+	}{
+		{0x0040, true},
+		{0x0041, false}, // the late response to another connection
+	} {
+		w := &rssiWriter{handle: tt.handle}
+		w.c = cmd.NewCmd(w)
+		h := &HCI{c: w.c}
+		rssi, err := h.ReadRSSI(&PlatData{Conn: &conn{attr: 0x0040}})
+		if (err == nil) != tt.ok || (tt.ok && rssi != -60) {
+			t.Errorf("handle 0x%04X: got %d, %v", tt.handle, rssi, err)
+		}
+	}
+}
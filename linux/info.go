@@ -0,0 +1,131 @@
+package linux
+
+import (
+	"fmt"
+
+	"github.com/paypal/gatt/linux/cmd"
+)
+
+// A ControllerInfo describes the controller of the HCI, as read from it at startup.
+type ControllerInfo struct {
+	HCIVersion    uint8
+	HCIRevision   uint16
+	LMPVersion    uint8
+	Manufacturer  uint16 // Company identifier assigned by the Bluetooth SIG.
+	LMPSubversion uint16
+
+	// SupportedCommands is the bit mask of the supported commands, as defined
+	// in the Bluetooth Core specification, Vol 2, Part E, 6.27.
+	SupportedCommands [64]byte
+
+	// LEFeatures is the bit mask of the supported LE features, as defined
+	// in the Bluetooth Core specification, Vol 6, Part B, 4.6.
+	LEFeatures uint64
+
+	// Address is the public address of the controller, most significant octet first.
+	Address [6]byte
+
+	// ACLDataPacketLength and TotalNumACLDataPackets are the size and
+	// the number of the buffers for the LE ACL data sent to the controller.
+	ACLDataPacketLength    int
+	TotalNumACLDataPackets int
+
+	// MaxAdvertisingDataLength is the maximum length of the advertising data.
+	// It's 31 unless the controller supports LE extended advertising.
+	MaxAdvertisingDataLength int
+}
+
+// leExtendedAdvertising is the LE feature bit of LE extended advertising.
+const leExtendedAdvertising = 1 << 12
+
+func (ci ControllerInfo) String() string {
+	a := ci.Address
+	return fmt.Sprintf("address %02X:%02X:%02X:%02X:%02X:%02X, HCI version %d rev 0x%04X, "+
+		"LMP version %d subversion 0x%04X, manufacturer 0x%04X, LE features 0x%016X, "+
+		"ACL buffers %d x %d bytes, max advertising data %d bytes",
+		a[0], a[1], a[2], a[3], a[4], a[5], ci.HCIVersion, ci.HCIRevision,
+		ci.LMPVersion, ci.LMPSubversion, ci.Manufacturer, ci.LEFeatures,
+		ci.TotalNumACLDataPackets, ci.ACLDataPacketLength, ci.MaxAdvertisingDataLength)
+}
+
+// ControllerInfo returns the information of the controller read at startup.
+func (h *HCI) ControllerInfo() ControllerInfo {
+	return h.info
+}
+
+// readInfo reads the information of the controller into h.info, and sizes the
+// ACL flow control from its buffers. Each field is recorded as it's read, and the
+// fields that fail to be read are left zero. The first error, if any, is returned.
+// It must be called before h.ready is closed.
+func (h *HCI) readInfo() error {
+	ci := &h.info
+	ci.MaxAdvertisingDataLength = 31
+	var first error
+	read := func(c cmd.CmdParam, rp interface{ Unmarshal([]byte) error }) bool {
+		err := h.read(c, rp)
+		if first == nil {
+			first = err
+		}
+		return err == nil
+	}
+
+	var ver cmd.ReadLocalVersionInformationRP
+	if read(cmd.ReadLocalVersionInformation{}, &ver) {
+		ci.HCIVersion, ci.HCIRevision = ver.HCIVersion, ver.HCIRevision
+		ci.LMPVersion, ci.Manufacturer, ci.LMPSubversion = ver.LMPPALVersion, ver.ManufacturerName, ver.LMPPALSubversion
+	}
+
+	var cmds cmd.ReadLocalSupportedCommandsRP
+	if read(cmd.ReadLocalSupportedCommands{}, &cmds) {
+		ci.SupportedCommands = cmds.SupportedCommands
+	}
+
+	var addr cmd.ReadBDADDRRP
+	if read(cmd.ReadBDADDR{}, &addr) {
+		ci.Address = addr.BDADDR
+	}
+
+	var feat cmd.LEReadLocalSupportedFeaturesRP
+	if read(cmd.LEReadLocalSupportedFeatures{}, &feat) {
+		ci.LEFeatures = feat.LEFeatures
+	}
+
+	// The controller shares the buffers between LE and BR/EDR, if it reports no LE buffers.
+	var lebuf cmd.LEReadBufferSizeRP
+	if read(cmd.LEReadBufferSize{}, &lebuf) {
+		ci.ACLDataPacketLength, ci.TotalNumACLDataPackets = int(lebuf.HCLEACLDataPacketLength), int(lebuf.HCTotalNumLEACLDataPackets)
+	}
+	if ci.ACLDataPacketLength == 0 {
+		var buf cmd.ReadBufferSizeRP
+		if read(cmd.ReadBufferSize{}, &buf) {
+			ci.ACLDataPacketLength, ci.TotalNumACLDataPackets = int(buf.HCACLDataPacketLength), int(buf.HCTotalNumACLDataPackets)
+		}
+	}
+	if ci.ACLDataPacketLength > 0 && ci.TotalNumACLDataPackets > 0 {
+		h.bufSize = ci.ACLDataPacketLength
+		h.bufCnt = make(chan struct{}, ci.TotalNumACLDataPackets)
+	}
+
+	if ci.LEFeatures&leExtendedAdvertising != 0 {
+		var adv cmd.LEReadMaxAdvDataLengthRP
+		if read(cmd.LEReadMaxAdvDataLength{}, &adv) {
+			ci.MaxAdvertisingDataLength = int(adv.MaxAdvertisingDataLength)
+		}
+	}
+
+	return first
+}
+
+// read sends the command c, and unmarshals the response into rp if it succeeds.
+func (h *HCI) read(c cmd.CmdParam, rp interface {
+	Unmarshal([]byte) error
+}) error {
+	rsp, err := h.c.Send(c)
+	if err != nil {
+		return err
+	}
+	if len(rsp) > 0 && rsp[0] != 0x00 {
+		return cmd.Error(rsp[0])
+	}
+	return rp.Unmarshal(rsp)
+}
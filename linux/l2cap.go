@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
 
 	"github.com/paypal/gatt/linux/cmd"
 )
@@ -34,13 +35,27 @@ type conn struct {
 	hci  *HCI
 	attr uint16
 	aclc chan *aclData
+
+	// wmu keeps the segments of concurrent writes from interleaving.
+	wmu *sync.Mutex
+
+	// donec is closed once the connection is disconnected.
+	donec chan struct{}
+
+	// reason is the reason of the disconnection, once disconnected.
+	reason error
+
+	// pd is the PlatData of the remote device.
+	pd *PlatData
 }
 
 func newConn(hci *HCI, hh uint16) *conn {
 	return &conn{
-		hci:  hci,
-		attr: hh,
-		aclc: make(chan *aclData),
+		hci:   hci,
+		attr:  hh,
+		aclc:  make(chan *aclData),
+		wmu:   &sync.Mutex{},
+		donec: make(chan struct{}),
 	}
 }
 
@@ -60,6 +75,9 @@ func (c *conn) updateConnection() (int, error) {
 // It first prepend the l2cap header (4-bytes), and diassemble the payload
 // if it is larger than the HCI LE buffer size that the conntroller can support.
 func (c *conn) write(cid int, b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
 	flag := uint8(0) // ACL data continuation flag
 	tlen := len(b)   // Total length of the l2cap payload
 
@@ -86,9 +104,13 @@ func (c *conn) write(cid int, b []byte) (int, error) {
 		w[4] = uint8(dlen >> 8)
 
 		// make sure we don't send more buffers than the controller can handdle
-		c.hci.bufCnt <- struct{}{}
+		if err := c.hci.acquireBuf(c.attr, c.donec); err != nil {
+			return 0, err
+		}
 
-		c.hci.d.Write(w[:5+dlen])
+		if _, err := c.hci.d.Write(w[:5+dlen]); err != nil {
+			return 0, err
+		}
 		w = w[dlen:] // advance the pointer to the next segment, if any.
 		flag = 0x10  // the rest of iterations attr continued segments, if any.
 		n -= dlen
@@ -97,9 +119,14 @@ func (c *conn) write(cid int, b []byte) (int, error) {
 	return len(b), nil
 }
 
+// Read reads an l2cap payload from the connection.
+// Once disconnected, it returns the reason of the disconnection, a cmd.Error, if known.
 func (c *conn) Read(b []byte) (int, error) {
-	a, ok := <-c.aclc
+	a, ok := c.recv()
 	if !ok {
+		if c.reason != nil {
+			return 0, c.reason
+		}
 		return 0, io.EOF
 	}
 	tlen := int(uint16(a.b[0]) | uint16(a.b[1])<<8)
@@ -112,7 +139,7 @@ func (c *conn) Read(b []byte) (int, error) {
 
 	// Keep receiving and reassemble continued l2cap segments
 	for n != tlen {
-		if a, ok = <-c.aclc; !ok || (a.flags&0x1) == 0 {
+		if a, ok = c.recv(); !ok || (a.flags&0x1) == 0 {
 			return n, io.ErrUnexpectedEOF
 		}
 		copy(b[n:], a.b)
@@ -122,6 +149,16 @@ func (c *conn) Read(b []byte) (int, error) {
 	return n, nil
 }
 
+// recv receives an ACL data packet of the connection, unless it's disconnected.
+func (c *conn) recv() (*aclData, bool) {
+	select {
+	case a := <-c.aclc:
+		return a, true
+	case <-c.donec:
+		return nil, false
+	}
+}
+
 func (c *conn) Write(b []byte) (int, error) {
 	return c.write(0x04, b)
 }
@@ -137,7 +174,7 @@ func (c *conn) Close() error {
 		// log.Printf("l2conn: 0x%04x already disconnected", hh)
 		return nil
 	}
-	if err, _ := h.c.Send(cmd.Disconnect{ConnectionHandle: hh, Reason: 0x13}); err != nil {
+	if _, err := h.c.Send(cmd.Disconnect{ConnectionHandle: hh, Reason: 0x13}); err != nil {
 		return fmt.Errorf("l2conn: failed to disconnect, %s", err)
 	}
 	return nil
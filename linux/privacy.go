@@ -0,0 +1,82 @@
+package linux
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+)
+
+// An IRK is the identity resolving key of a peer, along with its identity address,
+// to which the resolvable private addresses generated from Key are resolved.
+type IRK struct {
+	Key         [16]byte
+	AddressType uint8
+	Address     [6]byte
+}
+
+// ah is the random address hash function of the Bluetooth Core specification,
+// Vol 3, Part H, 2.2.2. Both the IRK k and the prand r are in the most significant octet first order.
+func ah(k [16]byte, r [3]byte) [3]byte {
+	c, _ := aes.NewCipher(k[:]) // The key length is always valid.
+	b := make([]byte, 16)
+	copy(b[13:], r[:])
+	c.Encrypt(b, b)
+	return [3]byte{b[13], b[14], b[15]}
+}
+
+// NewStaticAddress generates a random static address.
+// The two most significant bits are set to 1, and the rest are neither all 0 nor all 1.
+func NewStaticAddress() ([6]byte, error) {
+	var a [6]byte
+	for {
+		if _, err := rand.Read(a[:]); err != nil {
+			return a, err
+		}
+		a[0] |= 0xC0
+		if a != [6]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF} && a != [6]byte{0xC0} {
+			return a, nil
+		}
+	}
+}
+
+// NewResolvableAddress generates a resolvable private address from the IRK k.
+// The two most significant bits are set to 0 and 1, followed by 22 random bits of prand,
+// and the 24-bit hash of prand.
+func NewResolvableAddress(k [16]byte) ([6]byte, error) {
+	var a [6]byte
+	var r [3]byte
+	for {
+		if _, err := rand.Read(r[:]); err != nil {
+			return a, err
+		}
+		r[0] = r[0]&0x3F | 0x40
+		if r != [3]byte{0x40, 0x00, 0x00} && r != [3]byte{0x7F, 0xFF, 0xFF} {
+			break
+		}
+	}
+	h := ah(k, r)
+	copy(a[:3], r[:])
+	copy(a[3:], h[:])
+	return a, nil
+}
+
+// IsResolvableAddress reports whether a is a resolvable private address,
+// given it's a random address.
+func IsResolvableAddress(a [6]byte) bool {
+	return a[0]&0xC0 == 0x40
+}
+
+// ResolveAddress reports whether the resolvable private address a is generated from the IRK k.
+func ResolveAddress(k [16]byte, a [6]byte) bool {
+	if !IsResolvableAddress(a) {
+		return false
+	}
+	return ah(k, [3]byte{a[0], a[1], a[2]}) == [3]byte{a[3], a[4], a[5]}
+}
+
+// reverseKey reverses the order of the octets of k, which are sent to the controller least significant octet first.
+func reverseKey(k [16]byte) [16]byte {
+	for i, j := 0, len(k)-1; i < j; i, j = i+1, j-1 {
+		k[i], k[j] = k[j], k[i]
+	}
+	return k
+}
@@ -3,7 +3,9 @@ package gatt
 import (
 	"errors"
 	"io"
+	"time"
 
+	"github.com/paypal/gatt/linux"
 	"github.com/paypal/gatt/linux/cmd"
 )
 
@@ -73,6 +75,309 @@ func LnxSetAdvertisingParameters(c *cmd.LESetAdvertisingParameters) Option {
 	}
 }
 
+// ScanParams are the parameters of LE scanning on Linux implementation.
+type ScanParams struct {
+	// Active, if set, sends scan requests to scannable advertisers for their scan response data.
+	Active bool
+
+	// Interval is how often the controller scans, and Window is how long it scans each time.
+	// They range from 2.5 ms to 10.24 s, in steps of 0.625 ms, and Window can't exceed Interval.
+	Interval time.Duration
+	Window   time.Duration
+
+	// OwnAddressType is the type of the address used in scan requests.
+	// AddressRandom overrides LnxPublicAddress, and scans with the random address set, if any,
+	// by LnxStaticRandomAddress or LnxResolvablePrivateAddress. AddressPublic, the default,
+	// scans with the own address set by those options.
+	OwnAddressType AddressType
+
+	// FilterPolicy selects the advertisements the controller reports.
+	// 0x00: all, 0x01: only those of devices on the accept list (see LnxAddToAcceptList).
+	FilterPolicy uint8
+
+	// DutyOn and DutyPeriod, if set, duty-cycle the scan, which is enabled for DutyOn
+	// of every DutyPeriod, and disabled for the rest. This saves power on battery-powered devices,
+	// at the cost of missing advertisements while disabled.
+	DutyOn     time.Duration
+	DutyPeriod time.Duration
+}
+
+// DefaultScanParams are the scan parameters used unless set by LnxScanParams.
+var DefaultScanParams = ScanParams{
+	Active:   true,
+	Interval: 10 * time.Millisecond,
+	Window:   10 * time.Millisecond,
+}
+
+// lnxScanParams converts p to the scan parameters of the controller.
+func lnxScanParams(p ScanParams) (*cmd.LESetScanParameters, error) {
+	const min, max = 2500 * time.Microsecond, 10240 * time.Millisecond
+	switch {
+	case p.Interval < min || p.Interval > max || p.Window < min || p.Window > p.Interval:
+		return nil, errors.New("invalid scan interval or window")
+	case p.OwnAddressType > AddressRandom:
+		return nil, errors.New("invalid scan own address type")
+	case p.FilterPolicy > 0x03:
+		return nil, errors.New("invalid scan filter policy")
+	case p.DutyOn < 0 || (p.DutyOn > 0 && p.DutyPeriod <= p.DutyOn):
+		return nil, errors.New("invalid scan duty cycle")
+	}
+	typ := uint8(0x00) // passive
+	if p.Active {
+		typ = 0x01
+	}
+	return &cmd.LESetScanParameters{
+		LEScanType:           typ,
+		LEScanInterval:       uint16(p.Interval / 625 / time.Microsecond),
+		LEScanWindow:         uint16(p.Window / 625 / time.Microsecond),
+		OwnAddressType:       uint8(p.OwnAddressType),
+		ScanningFilterPolicy: p.FilterPolicy,
+	}, nil
+}
+
+// LnxScanParams sets the parameters of LE scanning, which are applied before scanning is enabled.
+// If the device is scanning, the scan is restarted with the parameters.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxScanParams(p ScanParams) Option {
+	return func(d Device) error {
+		c, err := lnxScanParams(p)
+		if err != nil {
+			return err
+		}
+		dd := d.(*device)
+		dd.scanmu.Lock()
+		defer dd.scanmu.Unlock()
+		dd.scanParam = c
+		dd.scanOn, dd.scanPeriod = p.DutyOn, p.DutyPeriod
+		if dd.scanning {
+			return dd.startScan()
+		}
+		return nil
+	}
+}
+
+// LnxAddToAcceptList adds the device of the address, such as "00:11:22:33:44:55", to the
+// Filter Accept List (white list) of the controller. The accept list can be used to ignore other devices
+// at the controller level by scanning (see ScanParams), advertising (see LnxAdvertisingFilterPolicy),
+// and connecting (see LnxAutoConnect).
+// This option can only be used with Option on Linux implementation.
+func LnxAddToAcceptList(addr string, t AddressType) Option {
+	return func(d Device) error {
+		a, err := parseAddr(addr)
+		if err != nil {
+			return err
+		}
+		dd := d.(*device)
+		return dd.changeLists(func() error { return dd.hci.AddToWhiteList(uint8(t), a) })
+	}
+}
+
+// LnxRemoveFromAcceptList removes the device of the address from the accept list of the controller.
+// This option can only be used with Option on Linux implementation.
+func LnxRemoveFromAcceptList(addr string, t AddressType) Option {
+	return func(d Device) error {
+		a, err := parseAddr(addr)
+		if err != nil {
+			return err
+		}
+		dd := d.(*device)
+		return dd.changeLists(func() error { return dd.hci.RemoveFromWhiteList(uint8(t), a) })
+	}
+}
+
+// LnxClearAcceptList removes all the devices from the accept list of the controller.
+// This option can only be used with Option on Linux implementation.
+func LnxClearAcceptList() Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		return dd.changeLists(func() error { return dd.hci.ClearWhiteList() })
+	}
+}
+
+// LnxAutoConnect sets whether to connect to the devices on the accept list, whenever they're found.
+// The connected peripherals are reported to the PeripheralConnected handler.
+// While enabled, Connect and Dial wait until a device on the list is connected, it's disabled,
+// or the context of Dial is done, as the controller connects to one device at a time.
+// This option can only be used with Option on Linux implementation.
+func LnxAutoConnect(en bool) Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		if dd.hci == nil {
+			return errors.New("device is not initialized")
+		}
+		dd.scanmu.Lock()
+		defer dd.scanmu.Unlock()
+		dd.stopAutoConnect()
+		if en {
+			dd.startAutoConnect()
+		}
+		return nil
+	}
+}
+
+// LnxAdvertisingFilterPolicy sets whether only the centrals on the accept list can scan,
+// and connect to the device, when advertising. It takes effect once advertising is started again.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxAdvertisingFilterPolicy(scan, conn bool) Option {
+	return func(d Device) error {
+		p := d.(*device).advParams()
+		p.AdvertisingFilterPolicy = 0x00 // [0x00]: any scan, any connection
+		if scan {
+			p.AdvertisingFilterPolicy |= 0x01 // scan from the accept list only
+		}
+		if conn {
+			p.AdvertisingFilterPolicy |= 0x02 // connection from the accept list only
+		}
+		return nil
+	}
+}
+
+// LnxPublicAddress sets the device to advertise, scan and connect with its public address, which is the default.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxPublicAddress() Option {
+	return func(d Device) error {
+		return d.(*device).applyOwnAddress(ownAddress{typ: 0x00})
+	}
+}
+
+// LnxStaticRandomAddress sets the device to advertise, scan and connect with a random static address,
+// such as "C0:11:22:33:44:55". If addr is empty, a new one is generated.
+// The two most significant bits of a random static address are set to 1.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxStaticRandomAddress(addr string) Option {
+	return func(d Device) error {
+		var a [6]byte
+		var err error
+		if addr == "" {
+			a, err = linux.NewStaticAddress()
+		} else if a, err = parseAddr(addr); err == nil && a[0]&0xC0 != 0xC0 {
+			err = errors.New("not a random static address")
+		}
+		if err != nil {
+			return err
+		}
+		return d.(*device).applyOwnAddress(ownAddress{typ: 0x01, static: a})
+	}
+}
+
+// LnxResolvablePrivateAddress sets the device to advertise, scan and connect with resolvable private addresses,
+// which are generated from the IRK (Identity Resolving Key) irk, and rotated every interval.
+// Only the peers that have the IRK, such as the bonded ones, can resolve them to the identity of the device.
+// If interval is 0, the addresses are rotated every 15 minutes.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxResolvablePrivateAddress(irk [16]byte, interval time.Duration) Option {
+	return func(d Device) error {
+		if interval == 0 {
+			interval = 15 * time.Minute
+		}
+		if interval < 0 {
+			return errors.New("invalid rotation interval")
+		}
+		return d.(*device).applyOwnAddress(ownAddress{typ: 0x01, irk: &irk, rotate: interval})
+	}
+}
+
+// An IRK is the Identity Resolving Key of a peer, which resolves its resolvable private addresses
+// to its identity address. It's usually distributed by the peer when bonding.
+type IRK struct {
+	Key         [16]byte // In the most significant octet first order.
+	Address     string   // Identity address, such as "00:11:22:33:44:55".
+	AddressType AddressType
+}
+
+// LnxAddIRK adds the IRK of a peer, with which the peripherals discovered by scanning, and
+// the connected peripherals and centrals, are identified by their identity addresses instead
+// of their resolvable private addresses, and report Resolved (see Resolvable).
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxAddIRK(k IRK) Option {
+	return func(d Device) error {
+		a, err := parseAddr(k.Address)
+		if err != nil {
+			return err
+		}
+		lk := linux.IRK{Key: k.Key, AddressType: uint8(k.AddressType), Address: a}
+		dd := d.(*device)
+		if dd.hci == nil {
+			dd.irks = append(dd.irks, lk)
+			return nil
+		}
+		return dd.changeLists(func() error { return dd.hci.AddIRK(lk) })
+	}
+}
+
+// LnxRemoveIRK removes the IRK of the peer with the identity address addr.
+// This option can only be used with Option on Linux implementation.
+func LnxRemoveIRK(addr string) Option {
+	return func(d Device) error {
+		a, err := parseAddr(addr)
+		if err != nil {
+			return err
+		}
+		dd := d.(*device)
+		if dd.hci == nil {
+			return errors.New("device is not initialized")
+		}
+		return dd.changeLists(func() error { return dd.hci.RemoveIRK(a) })
+	}
+}
+
+// LnxAddressResolution sets whether resolvable private addresses are resolved by the controller,
+// instead of the host, which offloads the resolution in busy environments.
+// Once enabled, the IRKs added by LnxAddIRK are loaded into the resolving list of the controller,
+// which requires a controller of Bluetooth 4.2 or later. The controller rotates the resolvable
+// private addresses it generates with the interval set by LnxResolvablePrivateAddress, if any.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxAddressResolution(en bool) Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		if dd.hci == nil {
+			dd.resolving = en
+			return nil
+		}
+		return dd.setAddressResolution(en)
+	}
+}
+
+// LnxAttributeCache sets the cache, which stores the profiles of remote peripherals
+// across connections. Once a peripheral has been discovered, it's rebuilt from the cache
+// when it reconnects, unless its Database Hash has changed, or it has indicated Service Changed.
+// The peripherals without a Database Hash are rebuilt from the cache only if they're bonded.
+// A profile is stored once the discovery settles, or the peripheral disconnects.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxAttributeCache(c AttributeCache) Option {
+	return func(d Device) error {
+		d.(*device).attrCache = c
+		return nil
+	}
+}
+
+// LnxReadDeviceName sets whether the GAP device name of remote peripherals is read once they're
+// connected, before the PeripheralConnected handler is called. The GAP device name takes priority
+// over the advertised one; the PeripheralNameChanged handler is called when they differ.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxReadDeviceName(b bool) Option {
+	return func(d Device) error {
+		d.(*device).readName = b
+		return nil
+	}
+}
+
+// LnxConnParams sets the parameters of the connections to remote peripherals initiated by Connect and Dial.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxConnParams(p ConnParams) Option {
+	return func(d Device) error {
+		cp, err := lnxConnParams(p)
+		if err != nil {
+			return err
+		}
+		d.(*device).connParams = &cp
+		if h := d.(*device).hci; h != nil {
+			h.SetConnParams(cp)
+		}
+		return nil
+	}
+}
+
 // LnxSendHCIRawCommand sends a raw command to the HCI device
 // This option can be used with NewDevice or Option on Linux implementation.
 func LnxSendHCIRawCommand(c cmd.CmdParam, rsp io.Writer) Option {
@@ -85,3 +390,20 @@ func LnxSendHCIRawCommand(c cmd.CmdParam, rsp io.Writer) Option {
 		return err
 	}
 }
+
+// LnxCapture captures all the HCI packets sent to and received from the controller to w,
+// in the btsnoop or pcap format of f, both of which can be opened by Wireshark.
+// If w is nil, the capture is stopped. With NewDevice, the capture includes the initialization
+// of the HCI device. With Option, the previous capture, if any, is stopped, and a new one,
+// with its own file header, is started.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxCapture(w io.Writer, f linux.CaptureFormat) Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		if dd.hci != nil {
+			return dd.hci.SetCapture(w, f)
+		}
+		dd.captureW, dd.captureF = w, f
+		return nil
+	}
+}
@@ -2,7 +2,13 @@ package gatt
 
 import (
 	"bytes"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
 
+	"github.com/paypal/gatt/linux"
 	"github.com/paypal/gatt/linux/cmd"
 )
 
@@ -54,6 +60,209 @@ func ExampleLnxSetAdvertisingParameters() {
 	d.Option(o)          // Or dynamically with Option.
 }
 
+func ExampleLnxConnParams() {
+	// A longer supervision timeout keeps the links through interference.
+	o := LnxConnParams(ConnParams{
+		IntervalMin:        30 * time.Millisecond,
+		IntervalMax:        50 * time.Millisecond,
+		Latency:            0,
+		SupervisionTimeout: 4 * time.Second,
+	})
+	d, _ := NewDevice(o) // Can be used with NewDevice.
+	d.Option(o)          // Or dynamically with Option.
+}
+
+func ExampleLnxScanParams() {
+	// Passively scan for 1 second of every 10 seconds.
+	p := DefaultScanParams
+	p.Active = false
+	p.DutyOn, p.DutyPeriod = time.Second, 10*time.Second
+	o := LnxScanParams(p)
+	d, _ := NewDevice(o) // Can be used with NewDevice.
+	d.Option(o)          // Or dynamically with Option.
+}
+
+func TestLnxScanParams(t *testing.T) {
+	c, err := lnxScanParams(ScanParams{
+		Interval:       100 * time.Millisecond,
+		Window:         50 * time.Millisecond,
+		OwnAddressType: AddressRandom,
+		FilterPolicy:   0x01,
+	})
+	if err != nil {
+		t.Fatalf("lnxScanParams: %v", err)
+	}
+	want := cmd.LESetScanParameters{
+		LEScanType:           0x00,
+		LEScanInterval:       0x00A0,
+		LEScanWindow:         0x0050,
+		OwnAddressType:       0x01,
+		ScanningFilterPolicy: 0x01,
+	}
+	if *c != want {
+		t.Errorf("lnxScanParams: got %+v want %+v", *c, want)
+	}
+
+	bad := []ScanParams{
+		{Interval: 2 * time.Millisecond, Window: 2 * time.Millisecond},
+		{Interval: 20 * time.Second, Window: 10 * time.Millisecond},
+		{Interval: 10 * time.Millisecond, Window: 20 * time.Millisecond},
+		{Interval: 10 * time.Millisecond, Window: 10 * time.Millisecond, FilterPolicy: 0x04},
+		{Interval: 10 * time.Millisecond, Window: 10 * time.Millisecond, OwnAddressType: 0x02},
+		{Interval: 10 * time.Millisecond, Window: 10 * time.Millisecond, DutyOn: time.Second, DutyPeriod: time.Second},
+	}
+	for _, p := range bad {
+		if _, err := lnxScanParams(p); err == nil {
+			t.Errorf("lnxScanParams(%+v): expected an error", p)
+		}
+	}
+}
+
+func ExampleLnxAddToAcceptList() {
+	// Ignore everything but our own sensors at the controller level.
+	d, _ := NewDevice(LnxAdvertisingFilterPolicy(true, true))
+	d.Option(
+		LnxClearAcceptList(),
+		LnxAddToAcceptList("00:11:22:33:44:55", AddressPublic),
+		LnxAddToAcceptList("C0:11:22:33:44:66", AddressRandom),
+		LnxAutoConnect(true),
+	) // Can only be used with Option.
+}
+
+func ExampleLnxResolvablePrivateAddress() {
+	// The IRK is to be generated once, and kept across restarts, for bonded peers to resolve the addresses.
+	irk := [16]byte{0xec, 0x02, 0x34, 0xa3, 0x57, 0xc8, 0xad, 0x05, 0x34, 0x10, 0x10, 0xa6, 0x0a, 0x39, 0x7d, 0x9b}
+	o := LnxResolvablePrivateAddress(irk, 15*time.Minute)
+	d, _ := NewDevice(o) // Can be used with NewDevice.
+	d.Option(o)          // Or dynamically with Option.
+}
+
+func TestLnxAdvertisingFilterPolicy(t *testing.T) {
+	d := &device{advParamSent: cmd.LESetAdvertisingParameters{AdvertisingIntervalMin: 0x800}}
+	cases := []struct {
+		scan, conn bool
+		want       uint8
+	}{
+		{false, false, 0x00},
+		{true, false, 0x01},
+		{false, true, 0x02},
+		{true, true, 0x03},
+	}
+	for _, tt := range cases {
+		d.advParam = nil
+		if err := d.Option(LnxAdvertisingFilterPolicy(tt.scan, tt.conn)); err != nil {
+			t.Fatalf("LnxAdvertisingFilterPolicy(%t, %t): %v", tt.scan, tt.conn, err)
+		}
+		if got := d.advParam.AdvertisingFilterPolicy; got != tt.want {
+			t.Errorf("LnxAdvertisingFilterPolicy(%t, %t): got 0x%02X want 0x%02X", tt.scan, tt.conn, got, tt.want)
+		}
+		if d.advParam.AdvertisingIntervalMin != 0x800 {
+			t.Errorf("LnxAdvertisingFilterPolicy(%t, %t): advertising parameters not preserved", tt.scan, tt.conn)
+		}
+	}
+}
+
+func TestResolvableAddress(t *testing.T) {
+	// Sample data of the Bluetooth Core specification, Vol 3, Part H, D.7.
+	irk := [16]byte{0xec, 0x02, 0x34, 0xa3, 0x57, 0xc8, 0xad, 0x05, 0x34, 0x10, 0x10, 0xa6, 0x0a, 0x39, 0x7d, 0x9b}
+	rpa := [6]byte{0x70, 0x81, 0x94, 0x0d, 0xfb, 0xaa}
+	if !linux.ResolveAddress(irk, rpa) {
+		t.Errorf("ResolveAddress(%x, %x): got false want true", irk, rpa)
+	}
+	rpa[5] ^= 0x01
+	if linux.ResolveAddress(irk, rpa) {
+		t.Errorf("ResolveAddress(%x, %x): got true want false", irk, rpa)
+	}
+
+	for i := 0; i < 16; i++ {
+		a, err := linux.NewResolvableAddress(irk)
+		if err != nil {
+			t.Fatalf("NewResolvableAddress: %v", err)
+		}
+		if a[0]&0xC0 != 0x40 || !linux.ResolveAddress(irk, a) {
+			t.Errorf("NewResolvableAddress: %x doesn't resolve", a)
+		}
+		s, err := linux.NewStaticAddress()
+		if err != nil {
+			t.Fatalf("NewStaticAddress: %v", err)
+		}
+		if s[0]&0xC0 != 0xC0 || linux.IsResolvableAddress(s) {
+			t.Errorf("NewStaticAddress: %x isn't static", s)
+		}
+	}
+}
+
+func TestLnxConnParams(t *testing.T) {
+	p := ConnParams{
+		IntervalMin:        7500 * time.Microsecond,
+		IntervalMax:        50 * time.Millisecond,
+		Latency:            4,
+		SupervisionTimeout: 4 * time.Second,
+		MaxCELength:        1250 * time.Microsecond,
+	}
+	lp, err := lnxConnParams(p)
+	if err != nil {
+		t.Fatalf("lnxConnParams: %v", err)
+	}
+	if lp.ConnIntervalMin != 0x0006 || lp.ConnIntervalMax != 0x0028 || lp.ConnLatency != 4 ||
+		lp.SupervisionTimeout != 0x0190 || lp.MinimumCELength != 0 || lp.MaximumCELength != 2 {
+		t.Errorf("lnxConnParams: got %+v", lp)
+	}
+	if got := gattConnParams(lp); got != p {
+		t.Errorf("gattConnParams: got %+v, want %+v", got, p)
+	}
+
+	bad := []ConnParams{
+		{IntervalMin: 5 * time.Millisecond, IntervalMax: 50 * time.Millisecond, SupervisionTimeout: time.Second},
+		{IntervalMin: 50 * time.Millisecond, IntervalMax: 30 * time.Millisecond, SupervisionTimeout: time.Second},
+		{IntervalMin: 30 * time.Millisecond, IntervalMax: 50 * time.Millisecond, Latency: 500, SupervisionTimeout: time.Second},
+		{IntervalMin: 30 * time.Millisecond, IntervalMax: 50 * time.Millisecond, SupervisionTimeout: 50 * time.Millisecond},
+		{IntervalMin: 30 * time.Millisecond, IntervalMax: 50 * time.Millisecond, Latency: 9, SupervisionTimeout: time.Second},
+	}
+	for _, p := range bad {
+		if _, err := lnxConnParams(p); err == nil {
+			t.Errorf("lnxConnParams(%+v): expected an error", p)
+		}
+	}
+}
+
+func ExampleLnxDevice() {
+	d, _ := NewDevice()
+	if d, ok := d.(LnxDevice); ok {
+		log.Printf("controller: %s", d.ControllerInfo())
+	}
+}
+
+func TestControllerInfoRP(t *testing.T) {
+	var addr cmd.ReadBDADDRRP
+	if err := addr.Unmarshal([]byte{0x00, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11}); err != nil {
+		t.Fatalf("ReadBDADDRRP: %v", err)
+	}
+	if addr.BDADDR != [6]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66} {
+		t.Errorf("ReadBDADDRRP: got %X", addr.BDADDR)
+	}
+
+	var buf cmd.LEReadBufferSizeRP
+	if err := buf.Unmarshal([]byte{0x00, 0xFB, 0x00, 0x08}); err != nil {
+		t.Fatalf("LEReadBufferSizeRP: %v", err)
+	}
+	if buf.HCLEACLDataPacketLength != 251 || buf.HCTotalNumLEACLDataPackets != 8 {
+		t.Errorf("LEReadBufferSizeRP: got %+v", buf)
+	}
+
+	var feat cmd.LEReadLocalSupportedFeaturesRP
+	if err := feat.Unmarshal([]byte{0x00, 0x01}); err == nil {
+		t.Errorf("LEReadLocalSupportedFeaturesRP: expected an error for a short response")
+	}
+}
+
+func ExampleLnxCapture() {
+	// Capture the HCI traffic to a file, which can be opened by Wireshark.
+	f, _ := os.Create("hci.btsnoop")
+	defer f.Close()
+	NewDevice(LnxCapture(f, linux.CaptureBTSnoop)) // Can be used with NewDevice, or dynamically with Option.
+}
+
 func ExampleLnxSendHCIRawCommand_predefinedCommand() {
 	// Send a predefined command of cmd package.
 	c := &cmd.LESetScanResponseData{
@@ -97,3 +306,19 @@ func ExampleLnxSendHCIRawCommand_customCommand() {
 	d, _ := NewDevice()
 	d.Option(LnxSendHCIRawCommand(c, nil)) // Can only be used with Option
 }
+
+func TestDisconnectReason(t *testing.T) {
+	cases := []struct {
+		err, want error
+	}{
+		{io.EOF, nil},
+		{cmd.ErrLocalHost, nil},
+		{cmd.ErrRemoteUser, cmd.ErrRemoteUser},
+		{cmd.ErrConnTimeout, cmd.ErrConnTimeout},
+	}
+	for _, tt := range cases {
+		if got := disconnectReason(tt.err); got != tt.want {
+			t.Errorf("disconnectReason(%v): got %v want %v", tt.err, got, tt.want)
+		}
+	}
+}
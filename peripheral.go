@@ -2,9 +2,22 @@ package gatt
 
 import (
 	"errors"
+	"io"
 	"sync"
+	"time"
 )
 
+// Resolvable is implemented by the Peripherals and Centrals that may use resolvable private
+// addresses. Resolved reports whether the address is resolved with a known IRK (see LnxAddIRK).
+// If so, ID is based on the identity address, which doesn't change over time.
+//
+//	if r, ok := p.(gatt.Resolvable); ok && r.Resolved() {
+//		// p.ID() identifies p across connections.
+//	}
+type Resolvable interface {
+	Resolved() bool
+}
+
 // Peripheral is the interface that represent a remote peripheral device.
 type Peripheral interface {
 	// Device returns the underlying device.
@@ -22,6 +35,8 @@ type Peripheral interface {
 
 	// DiscoverServices discover the specified services of the remote peripheral.
 	// If the specified services is set to nil, all the available services of the remote peripheral are returned.
+	// On Linux, if the device has an attribute cache or a PeripheralServicesModified handler,
+	// the Service Changed characteristic is also discovered, and its indications subscribed to.
 	DiscoverServices(s []UUID) ([]*Service, error)
 
 	// DiscoverIncludedServices discovers the specified included services of a service.
@@ -36,57 +51,433 @@ type Peripheral interface {
 	// If the specified descriptors is set to nil, all the descriptors of the characteristic are returned.
 	DiscoverDescriptors(d []UUID, c *Characteristic) ([]*Descriptor, error)
 
+	// DiscoverProfile discovers all the services, characteristics, and descriptors of the remote peripheral,
+	// and returns a snapshot of them. If read is set, the values of the readable characteristics,
+	// and of the descriptors, are read into the snapshot as well.
+	DiscoverProfile(read bool) (*Profile, error)
+
 	// ReadCharacteristic retrieves the value of a specified characteristic.
+	// Values too long to fit in a single response are read in full with Read Blob Requests.
 	ReadCharacteristic(c *Characteristic) ([]byte, error)
 
 	// ReadDescriptor retrieves the value of a specified characteristic descriptor.
+	// Values too long to fit in a single response are read in full with Read Blob Requests.
 	ReadDescriptor(d *Descriptor) ([]byte, error)
 
+	// ReadCharacteristicByUUID retrieves the values of the characteristics of type u
+	// within the handle range [start, end], without discovering them first.
+	ReadCharacteristicByUUID(u UUID, start, end uint16) ([]HandleValue, error)
+
+	// ReadMultipleCharacteristics retrieves the values of several characteristics at once.
+	// If the length of each value is known, and specified in sizes, a Read Multiple Request is used.
+	// If sizes is set to nil, a Read Multiple Variable Length Request is used.
+	// The values are read one by one if the peripheral supports neither.
+	ReadMultipleCharacteristics(cs []*Characteristic, sizes []int) ([][]byte, error)
+
 	// WriteCharacteristic writes the value of a characteristic.
+	// Values too long to fit in a single request are written with Prepare and Execute Write Requests.
+	// If noRsp is set, the value is written with a Write Command, which isn't acknowledged,
+	// and must fit in a single command.
 	WriteCharacteristic(c *Characteristic, b []byte, noRsp bool) error
 
+	// CharacteristicWriter returns a Writer, which streams data to a characteristic with Write Commands.
+	// The data is split in chunks that fit in a single command each.
+	// Writes block while the controller has no room for more packets, and fail once the peripheral disconnects.
+	CharacteristicWriter(c *Characteristic) io.Writer
+
 	// WriteDescriptor writes the value of a characteristic descriptor.
+	// Values too long to fit in a single request are written with Prepare and Execute Write Requests.
 	WriteDescriptor(d *Descriptor, b []byte) error
 
-	// SetNotifyValue sets notifications or indications for the value of a specified characteristic.
+	// BeginReliableWrite starts a reliable write transaction.
+	// No other long or reliable write can be made to the peripheral until the transaction ends.
+	BeginReliableWrite() (ReliableWrite, error)
+
+	// SetNotifyValue sets notifications for the value of a specified characteristic.
+	// The values are passed to f one at a time, in the order they were notified.
+	// No value is dropped; the values waiting for f are queued without bound,
+	// so f may make requests to the peripheral, but has to keep up on average.
+	// If f is set to nil, notifications are disabled.
 	SetNotifyValue(c *Characteristic, f func(*Characteristic, []byte, error)) error
 
+	// SetIndicateValue sets indications for the value of a specified characteristic.
+	// Each indication is confirmed to the peripheral automatically.
+	// The values are passed to f one at a time, in the order they were indicated,
+	// without dropping any, as SetNotifyValue does.
+	// If f is set to nil, indications are disabled.
+	SetIndicateValue(c *Characteristic, f func(*Characteristic, []byte, error)) error
+
+	// Subscribe sets notifications, or indications, for the value of a specified characteristic.
+	// The values are delivered on the channel of the returned subscription,
+	// which is closed once Unsubscribe is called or the peripheral disconnects.
+	Subscribe(c *Characteristic, o SubscribeOptions) (*Subscription, error)
+
 	// ReadRSSI retrieves the current RSSI value for the remote peripheral.
+	// 127 is returned if the RSSI isn't available.
 	ReadRSSI() int
+
+	// MonitorRSSI reads the RSSI value of the remote peripheral every interval,
+	// and calls f with the value whenever it changes, until stop is called or
+	// the peripheral disconnects. Nothing is monitored if interval isn't positive.
+	MonitorRSSI(interval time.Duration, f func(Peripheral, int)) (stop func())
+
+	// UpdateConnParams requests the parameters of the connection to the remote peripheral to be updated.
+	// The PeripheralConnParamsUpdated Handler is called with the parameters in use once the update completes.
+	UpdateConnParams(p ConnParams) error
+}
+
+// ConnParams are the parameters of a connection to a remote peripheral.
+type ConnParams struct {
+	// IntervalMin and IntervalMax are the range of the connection interval,
+	// from 7.5 ms to 4 s, in steps of 1.25 ms.
+	IntervalMin time.Duration
+	IntervalMax time.Duration
+
+	// Latency is the number of connection events the peripheral can skip, from 0 to 499.
+	Latency int
+
+	// SupervisionTimeout is the time without traffic after which the link is considered lost,
+	// from 100 ms to 32 s, in steps of 10 ms. It must be longer than (1 + Latency) * IntervalMax * 2.
+	SupervisionTimeout time.Duration
+
+	// MinCELength and MaxCELength are the range of the length of a connection event,
+	// in steps of 0.625 ms. They're hints to the controller, and are usually left zero.
+	MinCELength time.Duration
+	MaxCELength time.Duration
+}
+
+func (p ConnParams) validate() error {
+	switch {
+	case p.IntervalMin < 7500*time.Microsecond || p.IntervalMax > 4*time.Second || p.IntervalMin > p.IntervalMax:
+		return errors.New("invalid connection interval")
+	case p.Latency < 0 || p.Latency > 499:
+		return errors.New("invalid connection latency")
+	case p.SupervisionTimeout < 100*time.Millisecond || p.SupervisionTimeout > 32*time.Second:
+		return errors.New("invalid supervision timeout")
+	case p.SupervisionTimeout <= time.Duration(1+p.Latency)*p.IntervalMax*2:
+		return errors.New("supervision timeout too short for the connection interval and latency")
+	case p.MinCELength < 0 || p.MinCELength > p.MaxCELength:
+		return errors.New("invalid connection event length")
+	}
+	return nil
+}
+
+// A HandleValue is the value of an attribute, along with its handle.
+type HandleValue struct {
+	Handle uint16
+	Value  []byte
+}
+
+// characteristicWriter streams data to a characteristic in chunks of n bytes.
+type characteristicWriter struct {
+	p Peripheral
+	c *Characteristic
+	n int
+}
+
+func (w *characteristicWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		l := len(b)
+		if l > w.n {
+			l = w.n
+		}
+		if err := w.p.WriteCharacteristic(w.c, b[:l], true); err != nil {
+			return n, err
+		}
+		n += l
+		b = b[l:]
+	}
+	return n, nil
+}
+
+// A ReliableWrite is a reliable write transaction on a remote peripheral.
+// The peripheral queues the values written within the transaction,
+// and applies all of them at once when the transaction is executed.
+// Each queued value is checked against the one echoed by the peripheral;
+// on a mismatch, the transaction is cancelled and ErrReliableWriteMismatch returned.
+type ReliableWrite interface {
+	// WriteCharacteristic queues a write of the value of a characteristic.
+	WriteCharacteristic(c *Characteristic, b []byte) error
+
+	// WriteDescriptor queues a write of the value of a characteristic descriptor.
+	WriteDescriptor(d *Descriptor, b []byte) error
+
+	// Execute applies all the queued writes, and ends the transaction.
+	Execute() error
+
+	// Cancel discards all the queued writes, and ends the transaction.
+	Cancel() error
+}
+
+// DefaultQueueLen is the number of values a subscription queues for
+// delivery, if its SubscribeOptions doesn't specify one.
+const DefaultQueueLen = 64
+
+// An OverflowPolicy specifies what happens to a value notified
+// to a subscription whose queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest queued value to make room.
+	OverflowDropOldest OverflowPolicy = iota
+
+	// OverflowDropNewest discards the newly notified value.
+	OverflowDropNewest
+
+	// OverflowBlock stops handling anything else from the peripheral,
+	// including responses, until there's room in the queue.
+	// Requests to the peripheral must not be made from the receiver of the
+	// subscription while it's blocked, or the connection deadlocks.
+	OverflowBlock
+)
+
+// SubscribeOptions configures a subscription.
+type SubscribeOptions struct {
+	Indicate bool           // subscribe to indications instead of notifications
+	QueueLen int            // number of values queued for delivery; 0 means DefaultQueueLen
+	Overflow OverflowPolicy // what happens to a value notified while the queue is full
+}
+
+// A Subscription delivers the values notified, or indicated,
+// by a characteristic in the order they were received.
+type Subscription struct {
+	// C delivers the values. It is closed when the subscription ends.
+	C <-chan []byte
+
+	q        chan []byte
+	overflow OverflowPolicy
+	done     chan struct{}
+	once     sync.Once
+
+	// backlog queues the values without bound, instead of q, for the callbacks
+	// of SetNotifyValue and SetIndicateValue, which never block the peripheral.
+	// wake signals a value is appended.
+	grow      bool
+	backlog   [][]byte
+	backlogmu sync.Mutex
+	wake      chan struct{}
+
+	unsub func() error // disables the notifications on the peripheral
+}
+
+func newSubscription(o SubscribeOptions) *Subscription {
+	n := o.QueueLen
+	if n <= 0 {
+		n = DefaultQueueLen
+	}
+	return &Subscription{
+		q:        make(chan []byte, n),
+		overflow: o.Overflow,
+		done:     make(chan struct{}),
+	}
+}
+
+// newCallbackSubscription returns a subscription, which queues the values
+// for serve without bound.
+func newCallbackSubscription() *Subscription {
+	return &Subscription{
+		grow: true,
+		done: make(chan struct{}),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Unsubscribe disables the notifications, or indications, on the
+// peripheral, and ends the subscription.
+func (s *Subscription) Unsubscribe() error {
+	if s.unsub == nil {
+		s.stop()
+		return nil
+	}
+	return s.unsub()
+}
+
+// push queues b for delivery, following the overflow policy if the queue is full.
+func (s *Subscription) push(b []byte) {
+	if s.grow {
+		s.backlogmu.Lock()
+		s.backlog = append(s.backlog, b)
+		s.backlogmu.Unlock()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	switch s.overflow {
+	case OverflowBlock:
+		select {
+		case s.q <- b:
+		case <-s.done:
+		}
+		return
+	case OverflowDropNewest:
+		select {
+		case s.q <- b:
+		default:
+		}
+		return
+	}
+	for {
+		select {
+		case s.q <- b:
+			return
+		default:
+		}
+		select {
+		case <-s.q:
+		default:
+		}
+	}
+}
+
+// forward delivers the queued values on a new channel, which is set to C.
+func (s *Subscription) forward() {
+	c := make(chan []byte)
+	s.C = c
+	go func() {
+		defer close(c)
+		for {
+			select {
+			case b := <-s.q:
+				select {
+				case c <- b:
+				case <-s.done:
+					return
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// serve delivers the values queued in the backlog to f, one at a time.
+func (s *Subscription) serve(f func([]byte)) {
+	go func() {
+		for {
+			select {
+			case <-s.wake:
+			case <-s.done:
+				return
+			}
+			for b, ok := s.next(); ok; b, ok = s.next() {
+				select {
+				case <-s.done:
+					return
+				default:
+				}
+				f(b)
+			}
+		}
+	}()
+}
+
+// next takes the oldest value from the backlog, if any.
+func (s *Subscription) next() ([]byte, bool) {
+	s.backlogmu.Lock()
+	defer s.backlogmu.Unlock()
+	if len(s.backlog) == 0 {
+		return nil, false
+	}
+	b := s.backlog[0]
+	s.backlog[0] = nil
+	s.backlog = s.backlog[1:]
+	return b, true
+}
+
+func (s *Subscription) stop() {
+	s.once.Do(func() { close(s.done) })
 }
 
 type subscriber struct {
-	sub map[uint16]subscribefn
+	sub map[uint16]*Subscription
 	mu  *sync.Mutex
 }
 
-type subscribefn func([]byte, error)
-
 func newSubscriber() *subscriber {
 	return &subscriber{
-		sub: make(map[uint16]subscribefn),
+		sub: make(map[uint16]*Subscription),
 		mu:  &sync.Mutex{},
 	}
 }
 
-func (s *subscriber) subscribe(h uint16, f subscribefn) {
+// subscribe registers s for the values of handle h,
+// and ends the subscription it replaces, if any.
+func (s *subscriber) subscribe(h uint16, sub *Subscription) {
 	s.mu.Lock()
-	s.sub[h] = f
+	old := s.sub[h]
+	s.sub[h] = sub
 	s.mu.Unlock()
+	if old != nil && old != sub {
+		old.stop()
+	}
 }
 
-func (s *subscriber) unsubscribe(h uint16) {
+// unsubscribe ends the subscription for handle h, if it's sub.
+func (s *subscriber) unsubscribe(h uint16, sub *Subscription) {
 	s.mu.Lock()
-	delete(s.sub, h)
+	if s.sub[h] == sub {
+		delete(s.sub, h)
+	}
 	s.mu.Unlock()
+	sub.stop()
 }
 
-func (s *subscriber) fn(h uint16) subscribefn {
+func (s *subscriber) get(h uint16) *Subscription {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	return s.sub[h]
 }
 
+// stopAll ends all the subscriptions, once the peripheral disconnects.
+func (s *subscriber) stopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for h, sub := range s.sub {
+		sub.stop()
+		delete(s.sub, h)
+	}
+}
+
+// rssiUnavailable is the RSSI value reported when it can't be read.
+const rssiUnavailable = 127
+
+// monitorRSSI polls the RSSI of p every interval, and reports the changes to f,
+// until stop is called or quitc is closed. It does nothing if interval isn't positive.
+func monitorRSSI(p Peripheral, quitc chan struct{}, interval time.Duration, f func(Peripheral, int)) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		last := rssiUnavailable
+		for {
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			case <-quitc:
+				return
+			}
+			rssi := p.ReadRSSI()
+			if rssi == rssiUnavailable || rssi == last {
+				continue
+			}
+			last = rssi
+			f(p, rssi)
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
 var (
-	ErrInvalidLength = errors.New("invalid length")
+	ErrInvalidLength         = errors.New("invalid length")
+	ErrReliableWriteMismatch = errors.New("reliable write: echoed value mismatch")
+	ErrReliableWriteDone     = errors.New("reliable write: transaction ended")
+	ErrDisconnected          = errors.New("peripheral disconnected")
 )
@@ -1,7 +1,9 @@
 package gatt
 
 import (
+	"io"
 	"log"
+	"time"
 
 	"github.com/paypal/gatt/xpc"
 )
@@ -31,6 +33,7 @@ func NewPeripheral(u UUID) Peripheral { return &peripheral{id: xpc.UUID(u.b)} }
 
 func (p *peripheral) Device() Device       { return p.d }
 func (p *peripheral) ID() string           { return p.id.String() }
+func (p *peripheral) Resolved() bool       { return false }
 func (p *peripheral) Name() string         { return p.name }
 func (p *peripheral) Services() []*Service { return p.svcs }
 
@@ -78,6 +81,7 @@ func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characte
 	if res := rsp.MustGetInt("kCBMsgArgResult"); res != 0 {
 		return nil, attEcode(res)
 	}
+	s.chars = []*Characteristic{}
 	for _, xcs := range rsp.MustGetArray("kCBMsgArgCharacteristics") {
 		xc := xcs.(xpc.Dict)
 		u := MustParseUUID(xc.MustGetHexBytes("kCBMsgArgUUID"))
@@ -97,6 +101,7 @@ func (p *peripheral) DiscoverDescriptors(ds []UUID, c *Characteristic) ([]*Descr
 		"kCBMsgArgCharacteristicValueHandle": c.vh,
 		"kCBMsgArgUUIDs":                     uuidSlice(ds),
 	})
+	c.descs = []*Descriptor{}
 	for _, xds := range rsp.MustGetArray("kCBMsgArgDescriptors") {
 		xd := xds.(xpc.Dict)
 		u := MustParseUUID(xd.MustGetHexBytes("kCBMsgArgUUID"))
@@ -107,6 +112,10 @@ func (p *peripheral) DiscoverDescriptors(ds []UUID, c *Characteristic) ([]*Descr
 	return c.descs, nil
 }
 
+func (p *peripheral) DiscoverProfile(read bool) (*Profile, error) {
+	return discoverProfile(p, read)
+}
+
 func (p *peripheral) ReadCharacteristic(c *Characteristic) ([]byte, error) {
 	rsp := p.sendReq(64, xpc.Dict{
 		"kCBMsgArgDeviceUUID":                p.id,
@@ -120,6 +129,24 @@ func (p *peripheral) ReadCharacteristic(c *Characteristic) ([]byte, error) {
 	return b, nil
 }
 
+func (p *peripheral) ReadCharacteristicByUUID(u UUID, start, end uint16) ([]HandleValue, error) {
+	return nil, notImplemented
+}
+
+// ReadMultipleCharacteristics reads the values one by one;
+// core bluetooth doesn't expose Read Multiple Requests.
+func (p *peripheral) ReadMultipleCharacteristics(cs []*Characteristic, sizes []int) ([][]byte, error) {
+	vs := make([][]byte, 0, len(cs))
+	for _, c := range cs {
+		v, err := p.ReadCharacteristic(c)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
 func (p *peripheral) WriteCharacteristic(c *Characteristic, b []byte, noRsp bool) error {
 	args := xpc.Dict{
 		"kCBMsgArgDeviceUUID":                p.id,
@@ -139,6 +166,12 @@ func (p *peripheral) WriteCharacteristic(c *Characteristic, b []byte, noRsp bool
 	return nil
 }
 
+// CharacteristicWriter writes in chunks that fit the default ATT MTU;
+// core bluetooth doesn't expose the negotiated one.
+func (p *peripheral) CharacteristicWriter(c *Characteristic) io.Writer {
+	return &characteristicWriter{p: p, c: c, n: 20}
+}
+
 func (p *peripheral) ReadDescriptor(d *Descriptor) ([]byte, error) {
 	rsp := p.sendReq(76, xpc.Dict{
 		"kCBMsgArgDeviceUUID":       p.id,
@@ -163,16 +196,53 @@ func (p *peripheral) WriteDescriptor(d *Descriptor, b []byte) error {
 	return nil
 }
 
+func (p *peripheral) BeginReliableWrite() (ReliableWrite, error) {
+	return nil, notImplemented
+}
+
 func (p *peripheral) SetNotifyValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
-	set := 1
 	if f == nil {
-		set = 0
+		// Note: when notified, core bluetooth reports characteristic handle, not value's handle.
+		if s := p.sub.get(c.h); s != nil {
+			return s.Unsubscribe()
+		}
+		return p.setNotify(c, 0)
+	}
+	s := newCallbackSubscription()
+	s.serve(func(b []byte) { f(c, b, nil) })
+	return p.subscribe(c, s)
+}
+
+// Subscribe sets notifications for the value of c;
+// core bluetooth picks indications if the characteristic doesn't support notifications.
+func (p *peripheral) Subscribe(c *Characteristic, o SubscribeOptions) (*Subscription, error) {
+	s := newSubscription(o)
+	s.forward()
+	if err := p.subscribe(c, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *peripheral) subscribe(c *Characteristic, s *Subscription) error {
+	s.unsub = func() error {
+		var err error
+		if p.sub.get(c.h) == s {
+			err = p.setNotify(c, 0)
+		}
+		p.sub.unsubscribe(c.h, s)
+		return err
 	}
 	// To avoid race condition, registeration is handled before requesting the server.
-	if f != nil {
-		// Note: when notified, core bluetooth reports characteristic handle, not value's handle.
-		p.sub.subscribe(c.h, func(b []byte, err error) { f(c, b, err) })
+	p.sub.subscribe(c.h, s)
+	if err := p.setNotify(c, 1); err != nil {
+		p.sub.unsubscribe(c.h, s)
+		return err
 	}
+	return nil
+}
+
+func (p *peripheral) setNotify(c *Characteristic, set int) error {
 	rsp := p.sendReq(67, xpc.Dict{
 		"kCBMsgArgDeviceUUID":                p.id,
 		"kCBMsgArgCharacteristicHandle":      c.h,
@@ -182,18 +252,29 @@ func (p *peripheral) SetNotifyValue(c *Characteristic, f func(*Characteristic, [
 	if res := rsp.MustGetInt("kCBMsgArgResult"); res != 0 {
 		return attEcode(res)
 	}
-	// To avoid race condition, unregisteration is handled after server responses.
-	if f == nil {
-		p.sub.unsubscribe(c.h)
-	}
 	return nil
 }
 
+// SetIndicateValue is the same as SetNotifyValue on OS X;
+// core bluetooth picks indications if the characteristic doesn't support notifications.
+func (p *peripheral) SetIndicateValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	return p.SetNotifyValue(c, f)
+}
+
 func (p *peripheral) ReadRSSI() int {
 	rsp := p.sendReq(43, xpc.Dict{"kCBMsgArgDeviceUUID": p.id})
 	return rsp.MustGetInt("kCBMsgArgData")
 }
 
+func (p *peripheral) MonitorRSSI(interval time.Duration, f func(Peripheral, int)) (stop func()) {
+	return monitorRSSI(p, p.quitc, interval, f)
+}
+
+// UpdateConnParams is not supported on Darwin, where CoreBluetooth manages the connection parameters.
+func (p *peripheral) UpdateConnParams(cp ConnParams) error {
+	return notImplemented
+}
+
 func uuidSlice(uu []UUID) [][]byte {
 	us := [][]byte{}
 	for _, u := range uu {
@@ -245,17 +326,18 @@ func (p *peripheral) loop() {
 				// While we're notified with the value's handle, blued reports the characteristic handle.
 				ch := uint16(rsp.args.MustGetInt("kCBMsgArgCharacteristicHandle"))
 				b := rsp.args.MustGetBytes("kCBMsgArgData")
-				f := p.sub.fn(ch)
-				if f == nil {
+				s := p.sub.get(ch)
+				if s == nil {
 					log.Printf("notified by unsubscribed handle")
 					// FIXME: should terminate the connection?
 				} else {
-					go f(b, nil)
+					s.push(b)
 				}
 				break
 			}
 			rspc <- rsp
 		case <-p.quitc:
+			p.sub.stopAll()
 			return
 		}
 	}
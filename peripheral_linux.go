@@ -1,33 +1,54 @@
 package gatt
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/paypal/gatt/linux"
 )
 
 type peripheral struct {
-	// NameChanged is called whenever the peripheral GAP device name has changed.
-	NameChanged func(*peripheral)
+	d *device
 
-	// ServicedModified is called when one or more service of a peripheral have changed.
-	// A list of invalid service is provided in the parameter.
-	ServicesModified func(*peripheral, []*Service)
-
-	d    *device
-	svcs []*Service
+	// svcsmu guards svcs, and discmu serializes the discovery, including
+	// the one triggered by Service Changed indications.
+	svcs   []*Service
+	svcsmu sync.Mutex
+	discmu sync.Mutex
 
 	sub *subscriber
 
 	mtu uint16
 	l2c io.ReadWriteCloser
 
+	// prepmu serializes the use of the server's prepare write queue.
+	prepmu sync.Mutex
+
+	// name is the GAP device name, once it has been read.
+	name   string
+	namemu sync.Mutex
+
+	// cached is set while the services are rebuilt from a valid cached profile.
+	cached bool
+	dbHash []byte
+
+	// pending is the profile to be stored once the discovery settles for cacheDelay,
+	// and stored is the JSON of the profile last stored, which isn't stored again.
+	pending *Profile
+	storet  *time.Timer
+	stored  []byte
+	cachemu sync.Mutex
+
 	reqc  chan message
 	quitc chan struct{}
 
@@ -35,9 +56,27 @@ type peripheral struct {
 }
 
 func (p *peripheral) Device() Device       { return p.d }
-func (p *peripheral) ID() string           { return strings.ToUpper(net.HardwareAddr(p.pd.Address[:]).String()) }
-func (p *peripheral) Name() string         { return p.pd.Name }
-func (p *peripheral) Services() []*Service { return p.svcs }
+func (p *peripheral) ID() string           { return strings.ToUpper(net.HardwareAddr(p.addr()).String()) }
+func (p *peripheral) Resolved() bool       { return p.pd.Resolved }
+func (p *peripheral) Services() []*Service { return p.services() }
+
+// addr returns the identity address of the peripheral, if resolved, or its address.
+func (p *peripheral) addr() []byte {
+	if p.pd.Resolved {
+		return p.pd.IdentityAddress[:]
+	}
+	return p.pd.Address[:]
+}
+
+// Name returns the GAP device name, if it has been read, or the advertised name.
+func (p *peripheral) Name() string {
+	p.namemu.Lock()
+	defer p.namemu.Unlock()
+	if p.name != "" {
+		return p.name
+	}
+	return p.pd.Name
+}
 
 func finish(op byte, h uint16, b []byte) bool {
 	done := b[0] == attOpError && b[1] == op && b[2] == byte(h) && b[3] == byte(h>>8)
@@ -49,20 +88,54 @@ func finish(op byte, h uint16, b []byte) bool {
 	return done
 }
 
+// services returns the services discovered so far.
+func (p *peripheral) services() []*Service {
+	p.svcsmu.Lock()
+	defer p.svcsmu.Unlock()
+	return p.svcs
+}
+
+// setServices replaces the services discovered so far.
+func (p *peripheral) setServices(svcs []*Service) {
+	p.svcsmu.Lock()
+	defer p.svcsmu.Unlock()
+	p.svcs = svcs
+}
+
 func (p *peripheral) DiscoverServices(s []UUID) ([]*Service, error) {
 	// TODO: implement the UUID filters
 	// p.pd.Conn.Write([]byte{0x02, 0x87, 0x00}) // MTU
+	p.discmu.Lock()
+	defer p.discmu.Unlock()
+	if p.cached {
+		return p.services(), nil
+	}
+	svcs, err := p.discoverServices(0x0001, 0xFFFF)
+	if err != nil {
+		return nil, err
+	}
+	p.setServices(svcs)
+	p.storeCache()
+	p.watchServiceChanged()
+	return svcs, nil
+}
+
+// discoverServices discovers the primary services within the handle range [start, end].
+func (p *peripheral) discoverServices(start, end uint16) ([]*Service, error) {
+	svcs := []*Service{}
 	done := false
-	start := uint16(0x0001)
 	for !done {
 		op := byte(attOpReadByGroupReq)
 		b := make([]byte, 7)
 		b[0] = op
 		binary.LittleEndian.PutUint16(b[1:3], start)
-		binary.LittleEndian.PutUint16(b[3:5], 0xFFFF)
+		binary.LittleEndian.PutUint16(b[3:5], end)
 		binary.LittleEndian.PutUint16(b[5:7], 0x2800)
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(op, start, b) {
 			break
 		}
@@ -83,13 +156,13 @@ func (p *peripheral) DiscoverServices(s []UUID) ([]*Service, error) {
 				h:    h,
 				endh: endh,
 			}
-			p.svcs = append(p.svcs, s)
+			svcs = append(svcs, s)
 			b = b[l:]
-			done = endh == 0xFFFF
+			done = endh >= end
 			start = endh + 1
 		}
 	}
-	return p.svcs, nil
+	return svcs, nil
 }
 
 func (p *peripheral) DiscoverIncludedServices(ss []UUID, s *Service) ([]*Service, error) {
@@ -99,6 +172,17 @@ func (p *peripheral) DiscoverIncludedServices(ss []UUID, s *Service) ([]*Service
 
 func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characteristic, error) {
 	// TODO: implement the UUID filters
+	p.discmu.Lock()
+	defer p.discmu.Unlock()
+	return p.discoverCharacteristics(s)
+}
+
+// discoverCharacteristics discovers all the characteristics of s, with discmu held.
+func (p *peripheral) discoverCharacteristics(s *Service) ([]*Characteristic, error) {
+	if p.cached && s.chars != nil {
+		return s.chars, nil
+	}
+	s.chars = nil
 	done := false
 	start := s.h
 	var prev *Characteristic
@@ -110,7 +194,10 @@ func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characte
 		binary.LittleEndian.PutUint16(b[3:5], s.endh)
 		binary.LittleEndian.PutUint16(b[5:7], 0x2803)
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(op, start, b) {
 			break
 		}
@@ -129,7 +216,7 @@ func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characte
 			props := Property(b[2])
 			vh := binary.LittleEndian.Uint16(b[3:5])
 			u := UUID{b[5:l]}
-			s := searchService(p.svcs, h, vh)
+			s := searchService(p.services(), h, vh)
 			if s == nil {
 				log.Printf("Can't find service range that contains 0x%04X - 0x%04X", h, vh)
 				return nil, fmt.Errorf("Can't find service range that contains 0x%04X - 0x%04X", h, vh)
@@ -151,27 +238,46 @@ func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characte
 			prev = c
 		}
 	}
-	if len(s.chars) > 1 {
+	if len(s.chars) > 0 {
 		s.chars[len(s.chars)-1].endh = s.endh
 	}
+	if s.chars == nil {
+		s.chars = []*Characteristic{} // discovered, but none
+	}
+	p.storeCache()
 	return s.chars, nil
 }
 
 func (p *peripheral) DiscoverDescriptors(ds []UUID, c *Characteristic) ([]*Descriptor, error) {
 	// TODO: implement the UUID filters
-	done := false
+	p.discmu.Lock()
+	defer p.discmu.Unlock()
+	return p.discoverDescriptors(c)
+}
+
+// discoverDescriptors discovers all the descriptors of c, with discmu held.
+func (p *peripheral) discoverDescriptors(c *Characteristic) ([]*Descriptor, error) {
+	if p.cached && c.descs != nil {
+		return c.descs, nil
+	}
+	c.descs, c.cccd = nil, nil
+	if c.endh == 0 {
+		c.endh = c.svc.endh
+	}
+	// A characteristic that ends with its value has no descriptors.
+	done := c.vh >= c.endh
 	start := c.vh + 1
 	for !done {
-		if c.endh == 0 {
-			c.endh = c.svc.endh
-		}
 		op := byte(attOpFindInfoReq)
 		b := make([]byte, 5)
 		b[0] = op
 		binary.LittleEndian.PutUint16(b[1:3], start)
 		binary.LittleEndian.PutUint16(b[3:5], c.endh)
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(attOpFindInfoReq, start, b) {
 			break
 		}
@@ -201,74 +307,694 @@ func (p *peripheral) DiscoverDescriptors(ds []UUID, c *Characteristic) ([]*Descr
 			start = h + 1
 		}
 	}
+	if c.descs == nil {
+		c.descs = []*Descriptor{} // discovered, but none
+	}
+	p.storeCache()
 	return c.descs, nil
 }
 
+// loadCache reads the Database Hash of the peripheral, and rebuilds its
+// services from the cached profile, if the profile is still valid.
+// It fails only if the peripheral disconnects meanwhile.
+func (p *peripheral) loadCache() error {
+	p.discmu.Lock()
+	defer p.discmu.Unlock()
+	hvs, err := p.ReadCharacteristicByUUID(attrDatabaseHashUUID, 0x0001, 0xFFFF)
+	if err == ErrDisconnected {
+		return err
+	}
+	if err == nil && len(hvs) > 0 {
+		p.dbHash = hvs[0].Value
+	}
+	pf, err := p.d.attrCache.Load(p.ID())
+	if err != nil {
+		log.Printf("can't load the cached profile of %s: %s", p.ID(), err)
+		return nil
+	}
+	if pf == nil {
+		return nil
+	}
+	// Without a Database Hash, only a bonded peer tells whether its database
+	// has changed since the last connection, with a Service Changed indication.
+	if p.dbHash == nil && !p.bonded() {
+		return nil
+	}
+	if !bytes.Equal(pf.Hash, p.dbHash) {
+		p.invalidateCache()
+		return nil
+	}
+	p.setServices(pf.services())
+	p.cached = true
+	p.cachemu.Lock()
+	p.stored, _ = json.Marshal(pf)
+	p.cachemu.Unlock()
+	p.watchServiceChanged()
+	return nil
+}
+
+// bonded reports whether the peripheral is bonded, which is known only for
+// the ones resolved with IRKs, as the IRKs are distributed by bonding.
+func (p *peripheral) bonded() bool {
+	return p.pd.Resolved
+}
+
+// cacheDelay is how long the profile has to stay unchanged by discovery before it's stored.
+const cacheDelay = time.Second
+
+// storeCache schedules the profile discovered so far to be stored once the
+// discovery settles, if the device has a cache.
+func (p *peripheral) storeCache() {
+	if p.d == nil || p.d.attrCache == nil {
+		return
+	}
+	pf := newProfile(p.services())
+	pf.Hash = p.dbHash
+	p.cachemu.Lock()
+	defer p.cachemu.Unlock()
+	p.pending = pf
+	if p.storet == nil {
+		p.storet = time.AfterFunc(cacheDelay, p.flushCache)
+		return
+	}
+	p.storet.Reset(cacheDelay)
+}
+
+// flushCache stores the pending profile, if it has changed since last stored.
+func (p *peripheral) flushCache() {
+	p.cachemu.Lock()
+	defer p.cachemu.Unlock()
+	if p.storet != nil {
+		p.storet.Stop()
+	}
+	pf := p.pending
+	p.pending = nil
+	if pf == nil {
+		return
+	}
+	b, err := json.Marshal(pf)
+	if err == nil && bytes.Equal(b, p.stored) {
+		return
+	}
+	if err := p.d.attrCache.Store(p.ID(), pf); err != nil {
+		log.Printf("can't cache the profile of %s: %s", p.ID(), err)
+		return
+	}
+	p.stored = b
+}
+
+// watchServiceChanged subscribes to the indications of the Service Changed
+// characteristic, if the peripheral has one, with discmu held. It's done only if
+// the device has an attribute cache, or a PeripheralServicesModified handler.
+func (p *peripheral) watchServiceChanged() {
+	if p.d == nil || (p.d.attrCache == nil && p.d.peripheralServicesModified == nil) {
+		return
+	}
+	for _, s := range p.services() {
+		if !s.uuid.Equal(attrGATTUUID) {
+			continue
+		}
+		if s.chars == nil {
+			if _, err := p.discoverCharacteristics(s); err != nil {
+				return
+			}
+		}
+		for _, c := range s.chars {
+			if !c.uuid.Equal(attrServiceChangedUUID) {
+				continue
+			}
+			if c.descs == nil {
+				if _, err := p.discoverDescriptors(c); err != nil {
+					return
+				}
+			}
+			if c.cccd == nil {
+				return
+			}
+			if err := p.SetIndicateValue(c, p.serviceChanged); err != nil {
+				log.Printf("can't subscribe to service changed: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// serviceChanged handles a Service Changed indication. The services within the
+// indicated handle range are discovered again, and the ones they replace are
+// reported to the PeripheralServicesModified handler.
+func (p *peripheral) serviceChanged(c *Characteristic, b []byte, err error) {
+	if len(b) != 4 {
+		log.Printf("service changed: malformed value [ % X ]", b)
+		return
+	}
+	start := binary.LittleEndian.Uint16(b[0:2])
+	end := binary.LittleEndian.Uint16(b[2:4])
+	invalid, err := p.rediscover(start, end)
+	if err != nil {
+		log.Printf("service changed: can't discover services: %s", err)
+		return
+	}
+	if p.d != nil && p.d.peripheralServicesModified != nil {
+		p.d.peripheralServicesModified(p, invalid)
+	}
+}
+
+// rediscover discovers the services within the handle range [start, end] again,
+// and returns the ones they replace.
+func (p *peripheral) rediscover(start, end uint16) ([]*Service, error) {
+	p.discmu.Lock()
+	defer p.discmu.Unlock()
+	if p.d != nil && p.d.attrCache != nil {
+		p.invalidateCache()
+	}
+
+	var invalid, svcs []*Service
+	for _, s := range p.services() {
+		if s.h <= end && s.endh >= start {
+			invalid = append(invalid, s)
+			continue
+		}
+		svcs = append(svcs, s)
+	}
+	found, err := p.discoverServices(start, end)
+	if err != nil {
+		return nil, err
+	}
+	svcs = append(svcs, found...)
+	sort.Sort(byHandle(svcs))
+	p.setServices(svcs)
+	p.storeCache()
+
+	// The Service Changed characteristic itself may have moved.
+	for _, s := range invalid {
+		if s.uuid.Equal(attrGATTUUID) {
+			p.watchServiceChanged()
+			break
+		}
+	}
+	return invalid, nil
+}
+
+type byHandle []*Service
+
+func (s byHandle) Len() int           { return len(s) }
+func (s byHandle) Less(i, j int) bool { return s[i].h < s[j].h }
+func (s byHandle) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// invalidateCache removes the cached profile of the peripheral.
+// Services keeps returning the services rebuilt from it until they are discovered again.
+func (p *peripheral) invalidateCache() {
+	p.cached = false
+	p.cachemu.Lock()
+	p.pending, p.stored = nil, nil
+	p.cachemu.Unlock()
+	if err := p.d.attrCache.Remove(p.ID()); err != nil {
+		log.Printf("can't remove the cached profile of %s: %s", p.ID(), err)
+	}
+}
+
+func (p *peripheral) DiscoverProfile(read bool) (*Profile, error) {
+	return discoverProfile(p, read)
+}
+
 func (p *peripheral) ReadCharacteristic(c *Characteristic) ([]byte, error) {
-	b := make([]byte, 3)
-	op := byte(attOpReadReq)
-	b[0] = op
-	binary.LittleEndian.PutUint16(b[1:3], c.vh)
+	b, err := p.readLong(c.vh)
+	if err == nil && c.uuid.Equal(attrDeviceNameUUID) {
+		p.setName(string(b))
+	}
+	return b, err
+}
 
-	b = p.sendReq(op, b)
-	b = b[1:]
-	return b, nil
+// readName reads the GAP device name of the peripheral.
+// It fails only if the peripheral disconnects meanwhile.
+func (p *peripheral) readName() error {
+	hvs, err := p.ReadCharacteristicByUUID(attrDeviceNameUUID, 0x0001, 0xFFFF)
+	if err == ErrDisconnected {
+		return err
+	}
+	if err == nil && len(hvs) > 0 {
+		p.setName(string(hvs[0].Value))
+	}
+	return nil
+}
+
+// setName sets the GAP device name of the peripheral,
+// and calls the PeripheralNameChanged handler if the name has changed.
+func (p *peripheral) setName(name string) {
+	old := p.Name()
+	p.namemu.Lock()
+	p.name = name
+	p.namemu.Unlock()
+	if name != old && p.d != nil && p.d.peripheralNameChanged != nil {
+		p.d.peripheralNameChanged(p)
+	}
 }
 
 func (p *peripheral) WriteCharacteristic(c *Characteristic, value []byte, noRsp bool) error {
+	if noRsp {
+		return p.writeCmd(c.vh, value)
+	}
+	if len(value) > int(p.mtu)-3 {
+		return p.writeLong(c.vh, value)
+	}
 	b := make([]byte, 3+len(value))
 	op := byte(attOpWriteReq)
 	b[0] = op
-	if noRsp {
-		b[0] = attOpWriteCmd
-	}
 	binary.LittleEndian.PutUint16(b[1:3], c.vh)
 	copy(b[3:], value)
 
-	if !noRsp {
-		p.sendCmd(op, b)
-		return nil
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return err
 	}
-	b = p.sendReq(op, b)
-	// TODO: error handling
-	b = b[1:]
-	return nil
+	return rspErr(b)
+}
+
+// writeCmd writes value to the attribute at handle h with a Write Command.
+// Commands need no response, so they bypass the request queue, and are
+// only paced by the ACL buffers of the controller.
+func (p *peripheral) writeCmd(h uint16, value []byte) error {
+	if len(value) > int(p.mtu)-3 {
+		return ErrInvalidLength
+	}
+	b := make([]byte, 3+len(value))
+	b[0] = attOpWriteCmd
+	binary.LittleEndian.PutUint16(b[1:3], h)
+	copy(b[3:], value)
+
+	_, err := p.l2c.Write(b)
+	return err
+}
+
+func (p *peripheral) CharacteristicWriter(c *Characteristic) io.Writer {
+	return &characteristicWriter{p: p, c: c, n: int(p.mtu) - 3}
 }
 
 func (p *peripheral) ReadDescriptor(d *Descriptor) ([]byte, error) {
+	return p.readLong(d.h)
+}
+
+// readLong reads the value of the attribute at handle h.
+// A response that fills the whole PDU may carry a truncated value,
+// so readLong keeps issuing Read Blob Requests at the next offset
+// until the server returns a shorter response, or reports that the
+// attribute is not long or the offset is past its end.
+func (p *peripheral) readLong(h uint16) ([]byte, error) {
 	b := make([]byte, 3)
 	op := byte(attOpReadReq)
 	b[0] = op
-	binary.LittleEndian.PutUint16(b[1:3], d.h)
+	binary.LittleEndian.PutUint16(b[1:3], h)
+
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return nil, err
+	}
+	if err := rspErr(b); err != nil {
+		return nil, err
+	}
+	if len(b) < int(p.mtu) {
+		return b[1:], nil
+	}
+	return p.readBlob(h, b[1:])
+}
+
+// maxAttrLen is the maximum length of an attribute value.
+const maxAttrLen = 512
+
+// readBlob reads the rest of the value of the attribute at handle h,
+// of which v has been read, up to maxAttrLen.
+func (p *peripheral) readBlob(h uint16, v []byte) ([]byte, error) {
+	for len(v) < maxAttrLen {
+		op := byte(attOpReadBlobReq)
+		b := make([]byte, 5)
+		b[0] = op
+		binary.LittleEndian.PutUint16(b[1:3], h)
+		binary.LittleEndian.PutUint16(b[3:5], uint16(len(v)))
+
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
+		if err := rspErr(b); err != nil {
+			if err == attEcodeAttrNotLong || err == attEcodeInvalidOffset {
+				break
+			}
+			return nil, err
+		}
+		v = append(v, b[1:]...)
+		if len(b) < int(p.mtu) {
+			break
+		}
+	}
+	if len(v) > maxAttrLen {
+		v = v[:maxAttrLen]
+	}
+	return v, nil
+}
+
+func (p *peripheral) ReadCharacteristicByUUID(u UUID, start, end uint16) ([]HandleValue, error) {
+	var hvs []HandleValue
+	for start <= end {
+		op := byte(attOpReadByTypeReq)
+		b := make([]byte, 5+u.Len())
+		b[0] = op
+		binary.LittleEndian.PutUint16(b[1:3], start)
+		binary.LittleEndian.PutUint16(b[3:5], end)
+		copy(b[5:], u.b)
+
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
+		if err := rspErr(b); err != nil {
+			if err == attEcodeAttrNotFound {
+				break
+			}
+			return nil, err
+		}
+		if len(b) < 2 {
+			return nil, ErrInvalidLength
+		}
+		l, b := int(b[1]), b[2:]
+		if l < 2 || len(b) == 0 || len(b)%l != 0 {
+			return nil, ErrInvalidLength
+		}
+
+		var h uint16
+		for ; len(b) != 0; b = b[l:] {
+			h = binary.LittleEndian.Uint16(b[:2])
+			v := append([]byte(nil), b[2:l]...)
+			// A value as long as the response can carry may be truncated.
+			if l-2 == int(p.mtu)-4 || l == 255 {
+				var err error
+				if v, err = p.readBlob(h, v); err != nil {
+					return nil, err
+				}
+			}
+			hvs = append(hvs, HandleValue{Handle: h, Value: v})
+		}
+		if h == 0xFFFF {
+			break
+		}
+		start = h + 1
+	}
+	return hvs, nil
+}
+
+func (p *peripheral) ReadMultipleCharacteristics(cs []*Characteristic, sizes []int) ([][]byte, error) {
+	if sizes != nil && len(sizes) != len(cs) {
+		return nil, errors.New("sizes don't match the characteristics")
+	}
+	vs := make([][]byte, 0, len(cs))
+	n := (int(p.mtu) - 1) / 2 // number of handles that fit in a request
+	for i := 0; i < len(cs); i += n {
+		j := i + n
+		if j > len(cs) {
+			j = len(cs)
+		}
+		var batch [][]byte
+		var err error
+		switch {
+		case j-i == 1:
+			// A Read Multiple Request takes two handles at least.
+			var v []byte
+			v, err = p.readLong(cs[i].vh)
+			batch = [][]byte{v}
+		case sizes == nil:
+			batch, err = p.readMultiple(attOpReadMultiVarReq, cs[i:j], nil)
+		default:
+			batch, err = p.readMultiple(attOpReadMultiReq, cs[i:j], sizes[i:j])
+		}
+		if err == attEcodeReqNotSupp {
+			return p.readEach(vs, cs[i:])
+		}
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, batch...)
+	}
+	return vs, nil
+}
 
-	b = p.sendReq(op, b)
+// readMultiple reads the values of cs with a single Read Multiple Request,
+// or Read Multiple Variable Length Request. The values that don't fit in
+// the response are read in full afterwards.
+func (p *peripheral) readMultiple(op byte, cs []*Characteristic, sizes []int) ([][]byte, error) {
+	b := make([]byte, 1+2*len(cs))
+	b[0] = op
+	for i, c := range cs {
+		binary.LittleEndian.PutUint16(b[1+2*i:], c.vh)
+	}
+
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return nil, err
+	}
+	if err := rspErr(b); err != nil {
+		return nil, err
+	}
+	full := len(b) == int(p.mtu)
 	b = b[1:]
-	// TODO: error handling
-	return b, nil
+
+	vs := make([][]byte, 0, len(cs))
+	for i, c := range cs {
+		l, ok := 0, true
+		switch {
+		case op == attOpReadMultiReq:
+			l = sizes[i]
+		case len(b) >= 2:
+			l = int(binary.LittleEndian.Uint16(b[:2]))
+			b = b[2:]
+		default:
+			ok, b = false, nil // the length itself is truncated
+		}
+		if ok && len(b) >= l {
+			vs = append(vs, b[:l:l])
+			b = b[l:]
+			continue
+		}
+		if !full {
+			return nil, ErrInvalidLength
+		}
+		// The response is truncated; read the rest of the value.
+		var v []byte
+		var err error
+		if len(b) > 0 {
+			v, err = p.readBlob(c.vh, b)
+		} else {
+			v, err = p.readLong(c.vh)
+		}
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+		b = nil
+	}
+	return vs, nil
+}
+
+// readEach appends the values of cs, read one by one, to vs.
+func (p *peripheral) readEach(vs [][]byte, cs []*Characteristic) ([][]byte, error) {
+	for _, c := range cs {
+		v, err := p.readLong(c.vh)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
 }
 
 func (p *peripheral) WriteDescriptor(d *Descriptor, value []byte) error {
+	if len(value) > int(p.mtu)-3 {
+		return p.writeLong(d.h, value)
+	}
 	b := make([]byte, 3+len(value))
 	op := byte(attOpWriteReq)
 	b[0] = op
 	binary.LittleEndian.PutUint16(b[1:3], d.h)
 	copy(b[3:], value)
 
-	b = p.sendReq(op, b)
-	b = b[1:]
-	// TODO: error handling
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return err
+	}
+	return rspErr(b)
+}
+
+// writeLong writes a value too long for a single Write Request
+// to the attribute at handle h, and executes it right away.
+func (p *peripheral) writeLong(h uint16, value []byte) error {
+	p.prepmu.Lock()
+	defer p.prepmu.Unlock()
+	if err := p.prepareWrite(h, value); err != nil {
+		return err
+	}
+	return p.executeWrite(true)
+}
+
+// prepareWrite queues the value of the attribute at handle h on the
+// server, with as many Prepare Write Requests as needed.
+// If the server reports an error, or echoes a part of the value other
+// than the one sent, all the queued writes are cancelled.
+func (p *peripheral) prepareWrite(h uint16, value []byte) error {
+	n := int(p.mtu) - 5
+	for off := 0; off < len(value); off += n {
+		v := value[off:]
+		if len(v) > n {
+			v = v[:n]
+		}
+		b := make([]byte, 5+len(v))
+		op := byte(attOpPrepWriteReq)
+		b[0] = op
+		binary.LittleEndian.PutUint16(b[1:3], h)
+		binary.LittleEndian.PutUint16(b[3:5], uint16(off))
+		copy(b[5:], v)
+
+		rsp, err := p.sendReq(op, b)
+		if err != nil {
+			return err
+		}
+		if err := rspErr(rsp); err != nil {
+			p.executeWrite(false)
+			return err
+		}
+		if !bytes.Equal(rsp[1:], b[1:]) {
+			p.executeWrite(false)
+			return ErrReliableWriteMismatch
+		}
+	}
+	return nil
+}
+
+// executeWrite applies all the queued writes on the server, or
+// discards them if commit is false.
+func (p *peripheral) executeWrite(commit bool) error {
+	op := byte(attOpExecWriteReq)
+	b := []byte{op, 0x00}
+	if commit {
+		b[1] = 0x01
+	}
+	rsp, err := p.sendReq(op, b)
+	if err != nil {
+		return err
+	}
+	return rspErr(rsp)
+}
+
+func (p *peripheral) BeginReliableWrite() (ReliableWrite, error) {
+	p.prepmu.Lock()
+	return &reliableWrite{p: p}, nil
+}
+
+type reliableWrite struct {
+	p    *peripheral
+	done bool
+}
+
+func (w *reliableWrite) WriteCharacteristic(c *Characteristic, b []byte) error {
+	return w.write(c.vh, b)
+}
+
+func (w *reliableWrite) WriteDescriptor(d *Descriptor, b []byte) error {
+	return w.write(d.h, b)
+}
+
+func (w *reliableWrite) write(h uint16, b []byte) error {
+	if w.done {
+		return ErrReliableWriteDone
+	}
+	if err := w.p.prepareWrite(h, b); err != nil {
+		w.end()
+		return err
+	}
 	return nil
 }
 
+func (w *reliableWrite) Execute() error {
+	if w.done {
+		return ErrReliableWriteDone
+	}
+	defer w.end()
+	return w.p.executeWrite(true)
+}
+
+func (w *reliableWrite) Cancel() error {
+	if w.done {
+		return ErrReliableWriteDone
+	}
+	defer w.end()
+	return w.p.executeWrite(false)
+}
+
+func (w *reliableWrite) end() {
+	w.done = true
+	w.p.prepmu.Unlock()
+}
+
 func (p *peripheral) SetNotifyValue(c *Characteristic,
 	f func(*Characteristic, []byte, error)) error {
+	return p.setNotifyValue(c, gattCCCNotifyFlag, f)
+}
+
+func (p *peripheral) SetIndicateValue(c *Characteristic,
+	f func(*Characteristic, []byte, error)) error {
+	return p.setNotifyValue(c, gattCCCIndicateFlag, f)
+}
+
+func (p *peripheral) setNotifyValue(c *Characteristic, flag uint16,
+	f func(*Characteristic, []byte, error)) error {
+	if f == nil {
+		if s := p.sub.get(c.vh); s != nil {
+			return s.Unsubscribe()
+		}
+		return p.writeCCC(c, 0)
+	}
+	s := newCallbackSubscription()
+	s.serve(func(b []byte) { f(c, b, nil) })
+	return p.subscribe(c, flag, s)
+}
+
+func (p *peripheral) Subscribe(c *Characteristic, o SubscribeOptions) (*Subscription, error) {
+	flag := uint16(gattCCCNotifyFlag)
+	if o.Indicate {
+		flag = gattCCCIndicateFlag
+	}
+	s := newSubscription(o)
+	s.forward()
+	if err := p.subscribe(c, flag, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// subscribe registers s for the values of c, and enables them on the server.
+func (p *peripheral) subscribe(c *Characteristic, flag uint16, s *Subscription) error {
 	if c.cccd == nil {
+		s.stop()
 		return errors.New("no cccd") // FIXME
 	}
-	ccc := uint16(0)
-	if f != nil {
-		ccc = gattCCCNotifyFlag
-		p.sub.subscribe(c.vh, func(b []byte, err error) { f(c, b, err) })
+	s.unsub = func() error {
+		var err error
+		if p.sub.get(c.vh) == s {
+			err = p.writeCCC(c, 0)
+		}
+		p.sub.unsubscribe(c.vh, s)
+		return err
+	}
+	// To avoid race condition, registeration is handled before requesting the server.
+	p.sub.subscribe(c.vh, s)
+	if err := p.writeCCC(c, flag); err != nil {
+		p.sub.unsubscribe(c.vh, s)
+		return err
+	}
+	return nil
+}
+
+// writeCCC writes the client characteristic configuration of c.
+func (p *peripheral) writeCCC(c *Characteristic, ccc uint16) error {
+	if c.cccd == nil {
+		return errors.New("no cccd") // FIXME
 	}
 	b := make([]byte, 5)
 	op := byte(attOpWriteReq)
@@ -276,18 +1002,45 @@ func (p *peripheral) SetNotifyValue(c *Characteristic,
 	binary.LittleEndian.PutUint16(b[1:3], c.cccd.h)
 	binary.LittleEndian.PutUint16(b[3:5], ccc)
 
-	b = p.sendReq(op, b)
-	b = b[1:]
-	// TODO: error handling
-	if f == nil {
-		p.sub.unsubscribe(c.vh)
+	rsp, err := p.sendReq(op, b)
+	if err != nil {
+		return err
 	}
-	return nil
+	return rspErr(rsp)
 }
 
 func (p *peripheral) ReadRSSI() int {
-	// TODO: implement
-	return -1
+	rssi, err := p.d.hci.ReadRSSI(p.pd)
+	if err != nil {
+		return rssiUnavailable
+	}
+	return rssi
+}
+
+func (p *peripheral) MonitorRSSI(interval time.Duration, f func(Peripheral, int)) (stop func()) {
+	return monitorRSSI(p, p.quitc, interval, f)
+}
+
+func (p *peripheral) UpdateConnParams(cp ConnParams) error {
+	lp, err := lnxConnParams(cp)
+	if err != nil {
+		return err
+	}
+	return p.d.hci.UpdateConnParams(p.pd, lp)
+}
+
+// rspErr returns the ATT error carried by the response b, if any.
+func rspErr(b []byte) error {
+	if len(b) == 0 {
+		return ErrInvalidLength
+	}
+	if b[0] != attOpError {
+		return nil
+	}
+	if len(b) < 5 {
+		return ErrInvalidLength
+	}
+	return attEcode(b[4])
 }
 
 func searchService(ss []*Service, start, end uint16) *Service {
@@ -307,16 +1060,32 @@ type message struct {
 }
 
 func (p *peripheral) sendCmd(op byte, b []byte) {
-	p.reqc <- message{op: op, b: b}
+	select {
+	case p.reqc <- message{op: op, b: b}:
+	case <-p.quitc:
+	}
 }
 
-func (p *peripheral) sendReq(op byte, b []byte) []byte {
-	m := message{op: op, b: b, rspc: make(chan []byte)}
-	p.reqc <- m
-	return <-m.rspc
+// sendReq sends the request b, and waits for its response.
+// It fails with ErrDisconnected once the peripheral disconnects.
+func (p *peripheral) sendReq(op byte, b []byte) ([]byte, error) {
+	m := message{op: op, b: b, rspc: make(chan []byte, 1)}
+	select {
+	case p.reqc <- m:
+	case <-p.quitc:
+		return nil, ErrDisconnected
+	}
+	select {
+	case r := <-m.rspc:
+		return r, nil
+	case <-p.quitc:
+		return nil, ErrDisconnected
+	}
 }
 
-func (p *peripheral) loop() {
+// loop handles the responses and notifications of the peripheral until it disconnects,
+// and returns the error that ended the connection.
+func (p *peripheral) loop() error {
 	// Serialize the request.
 	rspc := make(chan []byte)
 
@@ -329,7 +1098,12 @@ func (p *peripheral) loop() {
 				if req.rspc == nil {
 					break
 				}
-				r := <-rspc
+				var r []byte
+				select {
+				case r = <-rspc:
+				case <-p.quitc:
+					return
+				}
 				switch reqOp, rspOp := req.b[0], r[0]; {
 				case rspOp == attRspFor[reqOp]:
 				case rspOp == attOpError && r[1] == reqOp:
@@ -353,23 +1127,28 @@ func (p *peripheral) loop() {
 		n, err := p.l2c.Read(buf)
 		if n == 0 || err != nil {
 			close(p.quitc)
-			return
+			p.sub.stopAll()
+			return err
 		}
 
 		b := make([]byte, n)
 		copy(b, buf)
 
-		if b[0] != attOpHandleNotify {
+		if b[0] != attOpHandleNotify && b[0] != attOpHandleInd {
 			rspc <- b
 			continue
 		}
 		h := binary.LittleEndian.Uint16(b[1:3])
-		f := p.sub.fn(h)
-		if f == nil {
+		s := p.sub.get(h)
+		if s == nil {
 			log.Printf("notified by unsubscribed handle")
 			// FIXME: terminate the connection?
-			continue
+		} else {
+			s.push(b[3:])
+		}
+		if b[0] == attOpHandleInd {
+			// The server sends no more indications until this one is confirmed.
+			p.l2c.Write([]byte{attOpHandleCnf})
 		}
-		go f(b[3:], nil)
 	}
 }
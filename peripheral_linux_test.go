@@ -0,0 +1,680 @@
+package gatt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/paypal/gatt/linux"
+)
+
+// exchange is a request expected from the peripheral, and the response the
+// scripted server replies with. An empty rsp means no response is expected.
+type exchange struct {
+	req string
+	rsp string
+}
+
+func newTestPeripheral(h *testHandler) *peripheral {
+	p := &peripheral{
+		mtu:   23,
+		l2c:   h,
+		reqc:  make(chan message),
+		quitc: make(chan struct{}),
+		sub:   newSubscriber(),
+	}
+	go p.loop()
+	return p
+}
+
+// serve plays the server side of the exchanges xx over h.
+func serve(t *testing.T, h *testHandler, xx []exchange) {
+	for _, x := range xx {
+		got := hex.EncodeToString(<-h.writec)
+		if got != x.req {
+			t.Errorf("request: got %s want %s", got, x.req)
+		}
+		if x.rsp == "" {
+			continue
+		}
+		b, _ := hex.DecodeString(x.rsp)
+		h.readc <- b
+	}
+}
+
+func TestReadLong(t *testing.T) {
+	// 22 bytes fill a response PDU with the default MTU of 23.
+	full := "0b" + hex.EncodeToString(bytes.Repeat([]byte{0xaa}, 22))
+	blob := "0d" + hex.EncodeToString(bytes.Repeat([]byte{0xbb}, 22))
+
+	// A value that never ends is read up to the maximum attribute length.
+	endless := []exchange{{"0a0300", full}}
+	for off := 22; off < maxAttrLen; off += 22 {
+		endless = append(endless, exchange{fmt.Sprintf("0c0300%02x%02x", byte(off), byte(off>>8)), blob})
+	}
+
+	cases := []struct {
+		name string
+		xx   []exchange
+		want []byte
+		err  error
+	}{
+		{
+			name: "short value -- single read",
+			xx:   []exchange{{"0a0300", "0b0102"}},
+			want: []byte{0x01, 0x02},
+		},
+		{
+			name: "long value -- read blob until a short response",
+			xx: []exchange{
+				{"0a0300", full},
+				{"0c03001600", blob},
+				{"0c03002c00", "0dcc"},
+			},
+			want: append(append(bytes.Repeat([]byte{0xaa}, 22), bytes.Repeat([]byte{0xbb}, 22)...), 0xcc),
+		},
+		{
+			name: "full value that isn't long -- stop on attribute not long",
+			xx: []exchange{
+				{"0a0300", full},
+				{"0c03001600", "010c03000b"},
+			},
+			want: bytes.Repeat([]byte{0xaa}, 22),
+		},
+		{
+			name: "value ends at the PDU boundary -- stop on invalid offset",
+			xx: []exchange{
+				{"0a0300", full},
+				{"0c03001600", "010c030007"},
+			},
+			want: bytes.Repeat([]byte{0xaa}, 22),
+		},
+		{
+			name: "endless value -- stop at the maximum attribute length",
+			xx:   endless,
+			want: append(bytes.Repeat([]byte{0xaa}, 22), bytes.Repeat([]byte{0xbb}, maxAttrLen-22)...),
+		},
+		{
+			name: "read not permitted",
+			xx:   []exchange{{"0a0300", "010a030002"}},
+			err:  attEcodeReadNotPerm,
+		},
+	}
+
+	for _, tt := range cases {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(h)
+		go serve(t, h, tt.xx)
+		got, err := p.ReadDescriptor(&Descriptor{h: 0x0003})
+		if err != tt.err {
+			t.Errorf("%s: got err %v want %v", tt.name, err, tt.err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % X want % X", tt.name, got, tt.want)
+		}
+	}
+
+	if err := rspErr(nil); err != ErrInvalidLength {
+		t.Errorf("rspErr(empty): got %v want %v", err, ErrInvalidLength)
+	}
+}
+
+func TestWriteLong(t *testing.T) {
+	// 18 bytes fill a Prepare Write Request with the default MTU of 23.
+	v := append(bytes.Repeat([]byte{0xaa}, 18), 0xbb, 0xcc, 0xdd)
+	p1 := "160300" + "0000" + hex.EncodeToString(v[:18])
+	p2 := "160300" + "1200" + "bbccdd"
+
+	cases := []struct {
+		name string
+		xx   []exchange
+		err  error
+	}{
+		{
+			name: "prepare and execute",
+			xx: []exchange{
+				{p1, "17" + p1[2:]},
+				{p2, "17" + p2[2:]},
+				{"1801", "19"},
+			},
+		},
+		{
+			name: "prepare queue full -- cancel",
+			xx: []exchange{
+				{p1, "17" + p1[2:]},
+				{p2, "0116030009"},
+				{"1800", "19"},
+			},
+			err: attEcodePrepQueueFull,
+		},
+	}
+	for _, tt := range cases {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(h)
+		go serve(t, h, tt.xx)
+		if err := p.WriteDescriptor(&Descriptor{h: 0x0003}, v); err != tt.err {
+			t.Errorf("%s: got err %v want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReliableWrite(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	go serve(t, h, []exchange{
+		{"16030000000102", "17030000000102"},
+		{"160500000003", "17050000ff03"}, // corrupted echo
+		{"1800", "19"},
+	})
+
+	w, _ := p.BeginReliableWrite()
+	if err := w.WriteCharacteristic(&Characteristic{vh: 0x0003}, []byte{0x01, 0x02}); err != nil {
+		t.Fatalf("prepare: got err %v want nil", err)
+	}
+	if err := w.WriteDescriptor(&Descriptor{h: 0x0005}, []byte{0x03}); err != ErrReliableWriteMismatch {
+		t.Errorf("prepare: got err %v want %v", err, ErrReliableWriteMismatch)
+	}
+	if err := w.Execute(); err != ErrReliableWriteDone {
+		t.Errorf("execute: got err %v want %v", err, ErrReliableWriteDone)
+	}
+}
+
+func TestIndication(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	c := &Characteristic{vh: 0x0003, cccd: &Descriptor{h: 0x0004}}
+	go serve(t, h, []exchange{{"1204000200", "13"}})
+
+	got := make(chan []byte)
+	err := p.SetIndicateValue(c, func(c *Characteristic, b []byte, err error) { got <- b })
+	if err != nil {
+		t.Fatalf("subscribe: got err %v want nil", err)
+	}
+
+	h.readc <- []byte{attOpHandleInd, 0x03, 0x00, 0x2a}
+	if b := <-got; !bytes.Equal(b, []byte{0x2a}) {
+		t.Errorf("indicated: got % X want 2A", b)
+	}
+	if b := <-h.writec; !bytes.Equal(b, []byte{attOpHandleCnf}) {
+		t.Errorf("confirmation: got % X want 1E", b)
+	}
+}
+
+func TestSetNotifyValueLossless(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	c := &Characteristic{vh: 0x0003, cccd: &Descriptor{h: 0x0004}}
+	go serve(t, h, []exchange{{"1204000100", "13"}})
+
+	gate := make(chan struct{})
+	got := make(chan byte, 2*DefaultQueueLen)
+	err := p.SetNotifyValue(c, func(c *Characteristic, b []byte, err error) {
+		<-gate
+		got <- b[0]
+	})
+	if err != nil {
+		t.Fatalf("subscribe: got err %v want nil", err)
+	}
+
+	// More values than DefaultQueueLen are notified while the callback is stuck,
+	// and the peripheral keeps being read, so requests are still answered.
+	n := 2 * DefaultQueueLen
+	for i := 0; i < n; i++ {
+		h.readc <- []byte{attOpHandleNotify, 0x03, 0x00, byte(i)}
+	}
+	go serve(t, h, []exchange{{"0a0300", "0b00"}})
+	if _, err := p.ReadCharacteristic(c); err != nil {
+		t.Fatalf("read: got err %v want nil", err)
+	}
+	close(gate)
+	for i := 0; i < n; i++ {
+		if b := <-got; b != byte(i) {
+			t.Fatalf("notified: got %02X want %02X", b, byte(i))
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	c := &Characteristic{vh: 0x0003, cccd: &Descriptor{h: 0x0004}}
+	go serve(t, h, []exchange{{"1204000100", "13"}})
+
+	s, err := p.Subscribe(c, SubscribeOptions{QueueLen: 2})
+	if err != nil {
+		t.Fatalf("subscribe: got err %v want nil", err)
+	}
+
+	// Nothing is received until all the values are notified,
+	// so the oldest ones are dropped to bound the queue.
+	for i := byte(0); i < 5; i++ {
+		h.readc <- []byte{attOpHandleNotify, 0x03, 0x00, i}
+	}
+	// A request after the notifications ensures the loop has queued them.
+	go serve(t, h, []exchange{{"0a0300", "0b00"}})
+	if _, err := p.ReadCharacteristic(c); err != nil {
+		t.Fatalf("read: got err %v want nil", err)
+	}
+
+	// The value already handed to the receiver, if any, comes first;
+	// the queue keeps the newest two.
+	var got []byte
+	for b := range s.C {
+		got = append(got, b[0])
+		if b[0] == 4 {
+			break
+		}
+	}
+	n := len(got)
+	if n < 2 || got[n-2] != 3 || (n == 3 && got[0] != 0) || n > 3 {
+		t.Errorf("notified: got % X want [00] 03 04", got)
+	}
+
+	go serve(t, h, []exchange{{"1204000000", "13"}})
+	if err := s.Unsubscribe(); err != nil {
+		t.Errorf("unsubscribe: got err %v want nil", err)
+	}
+	if _, ok := <-s.C; ok {
+		t.Errorf("unsubscribe: channel not closed")
+	}
+}
+
+func TestReadCharacteristicByUUID(t *testing.T) {
+	// 19 bytes fill a Read By Type response with the default MTU of 23.
+	long := hex.EncodeToString(bytes.Repeat([]byte{0xcc}, 19))
+
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	go serve(t, h, []exchange{
+		{"080100ffff192a", "0903030064"},
+		{"080400ffff192a", "0915" + "0800" + long},
+		{"0c08001300", "0ddd"},
+		{"080900ffff192a", "010809000a"},
+	})
+
+	hvs, err := p.ReadCharacteristicByUUID(UUID16(0x2a19), 0x0001, 0xffff)
+	if err != nil {
+		t.Fatalf("read: got err %v want nil", err)
+	}
+	want := []HandleValue{
+		{0x0003, []byte{0x64}},
+		{0x0008, append(bytes.Repeat([]byte{0xcc}, 19), 0xdd)},
+	}
+	if len(hvs) != len(want) {
+		t.Fatalf("read: got %d values want %d", len(hvs), len(want))
+	}
+	for i := range want {
+		if hvs[i].Handle != want[i].Handle || !bytes.Equal(hvs[i].Value, want[i].Value) {
+			t.Errorf("read: got %04X % X want %04X % X",
+				hvs[i].Handle, hvs[i].Value, want[i].Handle, want[i].Value)
+		}
+	}
+}
+
+func TestReadMultiple(t *testing.T) {
+	c1 := &Characteristic{vh: 0x0003}
+	c2 := &Characteristic{vh: 0x0005}
+	c3 := &Characteristic{vh: 0x0007}
+	// c2 doesn't fit in a response with the default MTU of 23.
+	v2 := bytes.Repeat([]byte{0xbb}, 20)
+
+	cases := []struct {
+		name  string
+		sizes []int
+		xx    []exchange
+	}{
+		{
+			name:  "fixed sizes -- truncated value read with read blob",
+			sizes: []int{1, 20, 2},
+			xx: []exchange{
+				{"0e030005000700", "0f01" + hex.EncodeToString(v2) + "03"},
+				{"0c07000100", "0d04"},
+			},
+		},
+		{
+			name: "variable lengths -- truncated value read with read blob, missing value read",
+			xx: []exchange{
+				{"20030005000700", "21010001" + "1400" + hex.EncodeToString(v2[:17])},
+				{"0c05001100", "0dbbbbbb"},
+				{"0a0700", "0b0304"},
+			},
+		},
+		{
+			name: "not supported -- read one by one",
+			xx: []exchange{
+				{"20030005000700", "0120030006"},
+				{"0a0300", "0b01"},
+				{"0a0500", "0b" + hex.EncodeToString(v2)},
+				{"0a0700", "0b0304"},
+			},
+		},
+	}
+	for _, tt := range cases {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(h)
+		go serve(t, h, tt.xx)
+		vs, err := p.ReadMultipleCharacteristics([]*Characteristic{c1, c2, c3}, tt.sizes)
+		if err != nil {
+			t.Errorf("%s: got err %v want nil", tt.name, err)
+			continue
+		}
+		want := [][]byte{{0x01}, v2, {0x03, 0x04}}
+		for i := range want {
+			if i >= len(vs) || !bytes.Equal(vs[i], want[i]) {
+				t.Errorf("%s: got % X want % X", tt.name, vs, want)
+				break
+			}
+		}
+	}
+}
+
+type memCache map[string]*Profile
+
+func (m memCache) Load(id string) (*Profile, error)   { return m[id], nil }
+func (m memCache) Store(id string, pf *Profile) error { m[id] = pf; return nil }
+func (m memCache) Remove(id string) error             { delete(m, id); return nil }
+
+func TestAttributeCache(t *testing.T) {
+	const id = "00:00:00:00:00:01"
+	s := &Service{uuid: UUID16(0x180F), h: 0x0001, endh: 0x0005}
+
+	cases := []struct {
+		name     string
+		hash     []byte
+		resolved bool
+		xx       []exchange
+		cached   bool
+		removed  bool
+	}{
+		{
+			name: "no database hash -- cache not trusted",
+			xx:   []exchange{{"080100ffff2a2b", "010801000a"}},
+		},
+		{
+			name:     "no database hash, bonded -- cache used",
+			resolved: true,
+			xx:       []exchange{{"080100ffff2a2b", "010801000a"}},
+			cached:   true,
+		},
+		{
+			name:   "same database hash",
+			hash:   []byte{0xaa, 0xbb},
+			xx:     []exchange{{"080100ffff2a2b", "09040300aabb"}, {"080400ffff2a2b", "010804000a"}},
+			cached: true,
+		},
+		{
+			name:    "database hash changed -- cache invalidated",
+			hash:    []byte{0xaa, 0xbb},
+			xx:      []exchange{{"080100ffff2a2b", "09040300aabc"}, {"080400ffff2a2b", "010804000a"}},
+			removed: true,
+		},
+	}
+	for _, tt := range cases {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(h)
+		pf := newProfile([]*Service{s})
+		pf.Hash = tt.hash
+		m := memCache{id: pf}
+		p.d = &device{attrCache: m}
+		p.pd = &linux.PlatData{Address: [6]byte{0, 0, 0, 0, 0, 1}, Resolved: tt.resolved}
+		if tt.resolved {
+			p.pd.IdentityAddress = p.pd.Address
+		}
+
+		go serve(t, h, tt.xx)
+		if err := p.loadCache(); err != nil {
+			t.Errorf("%s: loadCache: %s", tt.name, err)
+			continue
+		}
+		if p.cached != tt.cached || (m[id] == nil) != tt.removed {
+			t.Errorf("%s: got cached %t, removed %t want %t, %t", tt.name, p.cached, m[id] == nil, tt.cached, tt.removed)
+			continue
+		}
+		if !tt.cached {
+			continue
+		}
+		svcs, err := p.DiscoverServices(nil)
+		if err != nil || len(svcs) != 1 || !svcs[0].uuid.Equal(s.uuid) || svcs[0].endh != s.endh {
+			t.Errorf("%s: discover services: got %v, %v", tt.name, svcs, err)
+		}
+	}
+}
+
+// countCache counts the profiles stored in it.
+type countCache struct {
+	memCache
+	n int
+}
+
+func (c *countCache) Store(id string, pf *Profile) error { c.n++; return c.memCache.Store(id, pf) }
+
+func TestStoreCache(t *testing.T) {
+	c := &countCache{memCache: memCache{}}
+	p := &peripheral{d: &device{attrCache: c}, pd: &linux.PlatData{}}
+	p.svcs = []*Service{{uuid: UUID16(0x180F), h: 0x0001, endh: 0x0005}}
+
+	// The profile is stored once the discovery settles, not on every step.
+	p.storeCache()
+	p.svcs[0].chars = []*Characteristic{}
+	p.storeCache()
+	if c.n != 0 {
+		t.Fatalf("stored %d times before the discovery settled", c.n)
+	}
+	p.flushCache()
+	if c.n != 1 || c.memCache[p.ID()] == nil || c.memCache[p.ID()].Services[0].Characteristics == nil {
+		t.Fatalf("stored %d times, got %v", c.n, c.memCache[p.ID()])
+	}
+
+	// An unchanged profile isn't stored again.
+	p.storeCache()
+	p.flushCache()
+	if c.n != 1 {
+		t.Errorf("unchanged profile stored again")
+	}
+}
+
+func TestServiceChanged(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	modified := make(chan []*Service)
+	p.d = &device{}
+	p.d.peripheralServicesModified = func(_ Peripheral, ss []*Service) { modified <- ss }
+
+	gatt := &Service{uuid: attrGATTUUID, h: 0x0001, endh: 0x0005}
+	old := &Service{uuid: UUID16(0x180F), h: 0x0006, endh: 0x0009}
+	last := &Service{uuid: UUID16(0x180A), h: 0x000A, endh: 0xFFFF}
+	p.svcs = []*Service{gatt, old, last}
+
+	go serve(t, h, []exchange{
+		{"08010005000328", "09070200200300052a"},
+		{"08040005000328", "010804000a"},
+		{"0404000500", "050104000229"},
+		{"0405000500", "010405000a"},
+		{"1204000200", "13"},
+	})
+	p.watchServiceChanged()
+
+	// Services 0x0006 - 0x0009 changed.
+	h.readc <- []byte{attOpHandleInd, 0x03, 0x00, 0x06, 0x00, 0x09, 0x00}
+	// The confirmation races with the rediscovery of the changed range.
+	rsps := map[string]string{
+		"1e":             "",
+		"10060009000028": "1106060008000d18",
+		"10090009000028": "0110090009000a",
+	}
+	for len(rsps) > 0 {
+		req := hex.EncodeToString(<-h.writec)
+		rsp, ok := rsps[req]
+		if !ok {
+			t.Fatalf("request: got unexpected %s", req)
+		}
+		delete(rsps, req)
+		if rsp != "" {
+			b, _ := hex.DecodeString(rsp)
+			h.readc <- b
+		}
+	}
+
+	invalid := <-modified
+	if len(invalid) != 1 || invalid[0] != old {
+		t.Errorf("modified: got %v want [%v]", invalid, old)
+	}
+	svcs := p.Services()
+	if len(svcs) != 3 || svcs[0] != gatt || !svcs[1].uuid.Equal(UUID16(0x180D)) || svcs[1].endh != 0x0008 || svcs[2] != last {
+		t.Errorf("services: got %v", svcs)
+	}
+}
+
+func TestDiscoverProfile(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	// The only characteristic ends with its value, so there are no descriptors to discover.
+	go serve(t, h, []exchange{
+		{"100100ffff0028", "1106010003000f18"},
+		{"100400ffff0028", "011004000a"},
+		{"08010003000328", "09070200020300192a"},
+		{"0a0300", "0b64"},
+	})
+
+	pf, err := p.DiscoverProfile(true)
+	if err != nil {
+		t.Fatalf("discover: got err %v want nil", err)
+	}
+	b, err := json.Marshal(pf)
+	if err != nil {
+		t.Fatalf("marshal: got err %v want nil", err)
+	}
+	want := `{"services":[{"uuid":"180f","handle":1,"endHandle":3,"characteristics":[` +
+		`{"uuid":"2a19","properties":2,"handle":2,"valueHandle":3,"endHandle":3,"descriptors":[],"value":"ZA=="}]}]}`
+	if string(b) != want {
+		t.Errorf("profile:\ngot  %s\nwant %s", b, want)
+	}
+}
+
+func TestReadName(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	changed := make(chan string, 1)
+	p.d = &device{}
+	p.d.peripheralNameChanged = func(p Peripheral) { changed <- p.Name() }
+	p.pd = &linux.PlatData{Name: "Gop"}
+
+	go serve(t, h, []exchange{
+		{"080100ffff002a", "09080300476f70686572"},
+		{"080400ffff002a", "010804000a"},
+	})
+	if err := p.readName(); err != nil {
+		t.Fatalf("readName: %s", err)
+	}
+	select {
+	case name := <-changed:
+		if name != "Gopher" {
+			t.Errorf("name changed: got %q want %q", name, "Gopher")
+		}
+	default:
+		t.Errorf("name changed: not called")
+	}
+	if name := p.Name(); name != "Gopher" {
+		t.Errorf("name: got %q want %q", name, "Gopher")
+	}
+}
+
+func TestReadDisconnected(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+
+	// The peer drops the link instead of responding.
+	go func() {
+		<-h.writec
+		h.readc <- []byte{}
+	}()
+	if _, err := p.ReadCharacteristicByUUID(attrDeviceNameUUID, 0x0001, 0xFFFF); err != ErrDisconnected {
+		t.Errorf("pending request: got %v want %v", err, ErrDisconnected)
+	}
+	if err := p.readName(); err != ErrDisconnected {
+		t.Errorf("request after disconnection: got %v want %v", err, ErrDisconnected)
+	}
+}
+
+func TestWriteCharacteristic(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	c := &Characteristic{vh: 0x0003}
+
+	// A request waits for its response.
+	go serve(t, h, []exchange{{"1203000102", "0103030003"}})
+	if err := p.WriteCharacteristic(c, []byte{0x01, 0x02}, false); err != attEcodeWriteNotPerm {
+		t.Errorf("write request: got err %v want %v", err, attEcodeWriteNotPerm)
+	}
+
+	// A command doesn't.
+	go serve(t, h, []exchange{{"5203000102", ""}})
+	if err := p.WriteCharacteristic(c, []byte{0x01, 0x02}, true); err != nil {
+		t.Errorf("write command: got err %v want nil", err)
+	}
+	if err := p.WriteCharacteristic(c, make([]byte, 21), true); err != ErrInvalidLength {
+		t.Errorf("write command: got err %v want %v", err, ErrInvalidLength)
+	}
+
+	// The writer splits the data in commands.
+	data := bytes.Repeat([]byte{0xaa}, 45)
+	go serve(t, h, []exchange{
+		{"520300" + hex.EncodeToString(data[:20]), ""},
+		{"520300" + hex.EncodeToString(data[20:40]), ""},
+		{"520300" + hex.EncodeToString(data[40:]), ""},
+	})
+	if n, err := p.CharacteristicWriter(c).Write(data); n != len(data) || err != nil {
+		t.Errorf("writer: got %d, %v want %d, nil", n, err, len(data))
+	}
+}
+
+func TestResolvedID(t *testing.T) {
+	pd := &linux.PlatData{
+		AddressType: 0x01,
+		Address:     [6]byte{0x70, 0x81, 0x94, 0x0D, 0xFB, 0xAA},
+	}
+	var p Peripheral = &peripheral{pd: pd}
+	r := p.(Resolvable)
+	if got, want := p.ID(), "70:81:94:0D:FB:AA"; got != want || r.Resolved() {
+		t.Errorf("unresolved: got %s, %t want %s, false", got, r.Resolved(), want)
+	}
+	pd.Resolved = true
+	pd.IdentityAddress = [6]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	if got, want := p.ID(), "00:11:22:33:44:55"; got != want || !r.Resolved() {
+		t.Errorf("resolved: got %s, %t want %s, true", got, r.Resolved(), want)
+	}
+}
+
+func TestMonitorRSSIInterval(t *testing.T) {
+	// A non-positive interval monitors nothing, instead of panicking.
+	p := &peripheral{quitc: make(chan struct{})}
+	for _, d := range []time.Duration{0, -time.Second} {
+		stop := p.MonitorRSSI(d, func(Peripheral, int) { t.Errorf("MonitorRSSI(%v): f called", d) })
+		stop()
+	}
+}
+
+func TestDiscoverServicesNoWatch(t *testing.T) {
+	// Without an attribute cache or a PeripheralServicesModified handler,
+	// Service Changed isn't discovered nor subscribed to.
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(h)
+	p.d = &device{}
+	go serve(t, h, []exchange{
+		{"100100ffff0028", "1106010005000118"},
+		{"100600ffff0028", "011006000a"},
+	})
+	svcs, err := p.DiscoverServices(nil)
+	if err != nil || len(svcs) != 1 || !svcs[0].uuid.Equal(attrGATTUUID) {
+		t.Fatalf("discover services: got %v, %v", svcs, err)
+	}
+	select {
+	case b := <-h.writec:
+		t.Errorf("request: got unexpected % X", b)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,144 @@
+package gatt
+
+// A Profile is a snapshot of the attributes of a remote peripheral,
+// which has been discovered. It can be serialized, e.g. to JSON.
+type Profile struct {
+	// Hash is the Database Hash of the peripheral, if it exposes one.
+	Hash []byte `json:"hash,omitempty"`
+
+	Services []ServiceProfile `json:"services"`
+}
+
+// A ServiceProfile is a snapshot of a remote service.
+type ServiceProfile struct {
+	UUID      UUID   `json:"uuid"`
+	Handle    uint16 `json:"handle"`
+	EndHandle uint16 `json:"endHandle"`
+
+	// Characteristics is nil if the characteristics have not been discovered.
+	Characteristics []CharacteristicProfile `json:"characteristics"`
+}
+
+// A CharacteristicProfile is a snapshot of a remote characteristic.
+type CharacteristicProfile struct {
+	UUID        UUID     `json:"uuid"`
+	Properties  Property `json:"properties"`
+	Handle      uint16   `json:"handle"`
+	ValueHandle uint16   `json:"valueHandle"`
+	EndHandle   uint16   `json:"endHandle"`
+
+	// Descriptors is nil if the descriptors have not been discovered.
+	Descriptors []DescriptorProfile `json:"descriptors"`
+
+	// Value is set if the value has been read.
+	Value []byte `json:"value,omitempty"`
+}
+
+// A DescriptorProfile is a snapshot of a remote descriptor.
+type DescriptorProfile struct {
+	UUID   UUID   `json:"uuid"`
+	Handle uint16 `json:"handle"`
+
+	// Value is set if the value has been read.
+	Value []byte `json:"value,omitempty"`
+}
+
+// discoverProfile discovers all the services, characteristics, and descriptors of p.
+// If read is set, it also reads the values of the readable characteristics, and of
+// the descriptors; values that can't be read are left unset.
+func discoverProfile(p Peripheral, read bool) (*Profile, error) {
+	ss, err := p.DiscoverServices(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ss {
+		cs, err := p.DiscoverCharacteristics(nil, s)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cs {
+			if _, err := p.DiscoverDescriptors(nil, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	pf := newProfile(ss)
+	if !read {
+		return pf, nil
+	}
+	for i, s := range ss {
+		for j, c := range s.chars {
+			cp := &pf.Services[i].Characteristics[j]
+			if c.props&CharRead != 0 {
+				cp.Value, _ = p.ReadCharacteristic(c)
+			}
+			for k, d := range c.descs {
+				cp.Descriptors[k].Value, _ = p.ReadDescriptor(d)
+			}
+		}
+	}
+	return pf, nil
+}
+
+// newProfile takes a snapshot of the services svcs.
+func newProfile(svcs []*Service) *Profile {
+	pf := &Profile{Services: []ServiceProfile{}}
+	for _, s := range svcs {
+		sp := ServiceProfile{UUID: s.uuid, Handle: s.h, EndHandle: s.endh}
+		if s.chars != nil {
+			sp.Characteristics = []CharacteristicProfile{}
+		}
+		for _, c := range s.chars {
+			cp := CharacteristicProfile{
+				UUID:        c.uuid,
+				Properties:  c.props,
+				Handle:      c.h,
+				ValueHandle: c.vh,
+				EndHandle:   c.endh,
+			}
+			if c.descs != nil {
+				cp.Descriptors = []DescriptorProfile{}
+			}
+			for _, d := range c.descs {
+				cp.Descriptors = append(cp.Descriptors, DescriptorProfile{UUID: d.uuid, Handle: d.h})
+			}
+			sp.Characteristics = append(sp.Characteristics, cp)
+		}
+		pf.Services = append(pf.Services, sp)
+	}
+	return pf
+}
+
+// services rebuilds the services from the snapshot.
+func (pf *Profile) services() []*Service {
+	svcs := []*Service{}
+	for _, sp := range pf.Services {
+		s := &Service{uuid: sp.UUID, h: sp.Handle, endh: sp.EndHandle}
+		if sp.Characteristics != nil {
+			s.chars = []*Characteristic{}
+		}
+		for _, cp := range sp.Characteristics {
+			c := &Characteristic{
+				uuid:  cp.UUID,
+				svc:   s,
+				props: cp.Properties,
+				h:     cp.Handle,
+				vh:    cp.ValueHandle,
+				endh:  cp.EndHandle,
+			}
+			if cp.Descriptors != nil {
+				c.descs = []*Descriptor{}
+			}
+			for _, dp := range cp.Descriptors {
+				d := &Descriptor{uuid: dp.UUID, char: c, h: dp.Handle}
+				c.descs = append(c.descs, d)
+				if d.uuid.Equal(attrClientCharacteristicConfigUUID) {
+					c.cccd = d
+				}
+			}
+			s.chars = append(s.chars, c)
+		}
+		svcs = append(svcs, s)
+	}
+	return svcs
+}
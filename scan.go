@@ -0,0 +1,109 @@
+package gatt
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// A ScanFilter selects the advertisements that are reported to the PeripheralDiscovered handler.
+// An advertisement is reported only if it meets all the criteria that are set.
+// The zero value reports every advertisement.
+type ScanFilter struct {
+	// NamePrefix, if set, requires the local name to start with it.
+	NamePrefix string
+
+	// CompanyIDs, if set, requires the manufacturer data to be of one of the companies.
+	CompanyIDs []uint16
+
+	// ServiceDataUUIDs, if set, requires service data for one of the UUIDs.
+	ServiceDataUUIDs []UUID
+
+	// MinRSSI, if non-zero, requires the RSSI to be at least MinRSSI.
+	MinRSSI int
+
+	// Addresses, if set, requires the ID of the peripheral, which is its address on Linux,
+	// to be one of the addresses, such as "00:11:22:33:44:55".
+	Addresses []string
+}
+
+// SetScanFilter sets the filter for the advertisements reported during scan.
+// It applies in addition to the services specified to Scan. If f is nil, the filter is removed.
+// This option can be used with NewDevice or Option on both Linux and Darwin implementation.
+func SetScanFilter(f *ScanFilter) Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		dd.scanmu.Lock()
+		dd.scanFilter = f
+		dd.scanmu.Unlock()
+		return nil
+	}
+}
+
+// match reports whether an advertisement a from p, received with rssi, meets the criteria of f.
+func (f *ScanFilter) match(p Peripheral, a *Advertisement, rssi int) bool {
+	if f == nil {
+		return true
+	}
+	if !strings.HasPrefix(a.LocalName, f.NamePrefix) {
+		return false
+	}
+	if f.MinRSSI != 0 && rssi < f.MinRSSI {
+		return false
+	}
+	if len(f.CompanyIDs) > 0 {
+		if len(a.ManufacturerData) < 2 {
+			return false
+		}
+		id := binary.LittleEndian.Uint16(a.ManufacturerData)
+		found := false
+		for _, c := range f.CompanyIDs {
+			found = found || c == id
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.ServiceDataUUIDs) > 0 {
+		found := false
+		for _, sd := range a.ServiceData {
+			found = found || uuidIn(sd.UUID, f.ServiceDataUUIDs)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(f.Addresses) > 0 {
+		found := false
+		for _, addr := range f.Addresses {
+			found = found || strings.EqualFold(addr, p.ID())
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// advertisesAny reports whether a advertises any of the services ss.
+// An empty ss matches any advertisement.
+func advertisesAny(a *Advertisement, ss []UUID) bool {
+	if len(ss) == 0 {
+		return true
+	}
+	for _, u := range a.Services {
+		if uuidIn(u, ss) {
+			return true
+		}
+	}
+	return false
+}
+
+// uuidIn reports whether u is one of uu.
+func uuidIn(u UUID, uu []UUID) bool {
+	for _, v := range uu {
+		if u.Equal(v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package gatt
+
+import (
+	"testing"
+
+	"github.com/paypal/gatt/linux"
+)
+
+func TestScanFilter(t *testing.T) {
+	p := &peripheral{pd: &linux.PlatData{Address: [6]byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}}}
+	a := &Advertisement{
+		LocalName:        "Gopher",
+		ManufacturerData: []byte{0x4C, 0x00, 0x02, 0x15},
+		ServiceData:      []ServiceData{{UUID: UUID16(0x180F), Data: []byte{0x64}}},
+		Services:         []UUID{UUID16(0x180D)},
+	}
+	cases := []struct {
+		f    *ScanFilter
+		want bool
+	}{
+		{nil, true},
+		{&ScanFilter{}, true},
+		{&ScanFilter{NamePrefix: "Go"}, true},
+		{&ScanFilter{NamePrefix: "Rust"}, false},
+		{&ScanFilter{CompanyIDs: []uint16{0x0059, 0x004C}}, true},
+		{&ScanFilter{CompanyIDs: []uint16{0x0059}}, false},
+		{&ScanFilter{ServiceDataUUIDs: []UUID{UUID16(0x180F)}}, true},
+		{&ScanFilter{ServiceDataUUIDs: []UUID{UUID16(0x180D)}}, false},
+		{&ScanFilter{MinRSSI: -70}, true},
+		{&ScanFilter{MinRSSI: -50}, false},
+		{&ScanFilter{Addresses: []string{"00:11:22:33:44:55"}}, true},
+		{&ScanFilter{Addresses: []string{"00:11:22:33:44:66"}}, false},
+		{&ScanFilter{NamePrefix: "Go", MinRSSI: -50}, false},
+	}
+	for _, tt := range cases {
+		if got := tt.f.match(p, a, -60); got != tt.want {
+			t.Errorf("%+v: got %t want %t", tt.f, got, tt.want)
+		}
+	}
+
+	if !advertisesAny(a, nil) {
+		t.Errorf("advertisesAny(nil): got false want true")
+	}
+	if !advertisesAny(a, []UUID{UUID16(0x180F), UUID16(0x180D)}) {
+		t.Errorf("advertisesAny(180f, 180d): got false want true")
+	}
+	if advertisesAny(a, []UUID{UUID16(0x180F)}) {
+		t.Errorf("advertisesAny(180f): got true want false")
+	}
+}